@@ -0,0 +1,124 @@
+//go:build bench
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+func benchmarkBinaryReadDecode(b *testing.B) {
+	raw := sampleHttpEventRecord()
+	b.ReportAllocs()
+	for b.Loop() {
+		var event HttpEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkManualDecode(b *testing.B) {
+	raw := sampleHttpEventRecord()
+	var event HttpEvent
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := event.Decode(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkFuncEventDecode(b *testing.B) {
+	raw := make([]byte, funcEventSize)
+	binary.LittleEndian.PutUint64(raw[8:], 250000)
+	var event FuncEvent
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := event.Decode(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkPercentile measures the P99 of a window of n latencies from generate
+func benchmarkPercentile(n int, generate func(rng *rand.Rand, n int) []uint64) func(b *testing.B) {
+	return func(b *testing.B) {
+		latencies := generate(rand.New(rand.NewPCG(1, 2)), n)
+		b.ReportAllocs()
+		for b.Loop() {
+			CalculatePercentile(latencies, 99)
+		}
+	}
+}
+
+// benchmarkSeparatePercentiles measures P50, P95 and P99 with one selection each
+func benchmarkSeparatePercentiles(b *testing.B) {
+	latencies := latencyDistributions[3].generate(rand.New(rand.NewPCG(1, 2)), 100000)
+	b.ReportAllocs()
+	for b.Loop() {
+		CalculatePercentile(latencies, 50)
+		CalculatePercentile(latencies, 95)
+		CalculatePercentile(latencies, 99)
+	}
+}
+
+// benchmarkMultiplePercentiles measures P50, P95 and P99 with a single multi-select
+func benchmarkMultiplePercentiles(b *testing.B) {
+	latencies := latencyDistributions[3].generate(rand.New(rand.NewPCG(1, 2)), 100000)
+	b.ReportAllocs()
+	for b.Loop() {
+		CalculateMultiplePercentiles(latencies, standardPercentiles, NearestRank)
+	}
+}
+
+// benchmarkHistogram measures bucketing a window of 100000 latencies into a log-linear histogram
+func benchmarkHistogram(b *testing.B) {
+	latencies := latencyDistributions[3].generate(rand.New(rand.NewPCG(1, 2)), 100000)
+	layout, err := LogLinearLayout(10, 10000000, 4)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		histogram := NewLatencyHistogram(layout)
+		for _, latency := range latencies {
+			histogram.Add(latency, 1)
+		}
+	}
+}
+
+func runBenchmarks() {
+	fmt.Printf("Running Go component benchmarks...\n\n")
+
+	benchmarks := []struct {
+		name string
+		fn   func(b *testing.B)
+	}{
+		{"HttpEvent binary.Read", benchmarkBinaryReadDecode},
+		{"HttpEvent Decode", benchmarkManualDecode},
+		{"FuncEvent Decode", benchmarkFuncEventDecode},
+		{"P50/95/99 separate/100000", benchmarkSeparatePercentiles},
+		{"P50/95/99 multi/100000", benchmarkMultiplePercentiles},
+		{"Histogram log-linear/100000", benchmarkHistogram},
+	}
+
+	for _, n := range []int{10000, 100000} {
+		for _, dist := range latencyDistributions {
+			benchmarks = append(benchmarks, struct {
+				name string
+				fn   func(b *testing.B)
+			}{fmt.Sprintf("P99 %s/%d", dist.name, n), benchmarkPercentile(n, dist.generate)})
+		}
+	}
+
+	for _, bm := range benchmarks {
+		result := testing.Benchmark(bm.fn)
+		fmt.Printf("  %-28s %s %s\n", bm.name, result.String(), result.MemString())
+	}
+
+	fmt.Printf("\nAll benchmarks completed!\n")
+}
@@ -0,0 +1,11 @@
+//go:build !bench
+
+package main
+
+import "log"
+
+// runBenchmarks is only linked with the bench tag, so the testing package
+// stays out of the agent binary
+func runBenchmarks() {
+	log.Fatal("-bench needs a build with -tags bench")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// debugFileDir is where distributions install separate debug info, e.g. nginx-dbg
+const debugFileDir = "/usr/lib/debug/.build-id"
+
+// openDWARF returns the DWARF data of the executable at path, falling back to
+// a separate debug file located by build-id when the binary is stripped
+func openDWARF(path string) (*dwarf.Data, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := f.DWARF()
+	if err == nil {
+		return data, nil
+	}
+
+	buildID := readBuildID(f)
+	if len(buildID) < 3 {
+		return nil, fmt.Errorf("no DWARF and no build-id: %w", err)
+	}
+
+	debugPath := filepath.Join(debugFileDir, buildID[:2], buildID[2:]+".debug")
+	debugFile, debugErr := elf.Open(debugPath)
+	if debugErr != nil {
+		return nil, fmt.Errorf("no DWARF (%v) and no debug file: %w", err, debugErr)
+	}
+	defer debugFile.Close()
+
+	return debugFile.DWARF()
+}
+
+// dwarfMember names a struct member, possibly nested, e.g. {"ngx_http_request_s", "headers_in.content_length_n"}
+type dwarfMember struct {
+	Type   string // struct or typedef name
+	Member string // dot-separated member path
+}
+
+// dwarfMemberOffsets resolves the byte offset of every member in a single pass over the DWARF data
+func dwarfMemberOffsets(data *dwarf.Data, members []dwarfMember) (map[dwarfMember]uint64, error) {
+	structs := make(map[string]*dwarf.StructType)
+	for _, m := range members {
+		structs[m.Type] = nil
+	}
+
+	reader := data.Reader()
+	remaining := len(structs)
+	for remaining > 0 {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagStructType && entry.Tag != dwarf.TagTypedef {
+			continue
+		}
+
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		if st, ok := structs[name]; !ok || st != nil {
+			continue
+		}
+
+		typ, err := data.Type(entry.Offset)
+		if err != nil {
+			continue
+		}
+		if st := asStruct(typ); st != nil && !st.Incomplete {
+			structs[name] = st
+			remaining--
+		}
+	}
+
+	found := make(map[dwarfMember]uint64, len(members))
+	for _, m := range members {
+		st := structs[m.Type]
+		if st == nil {
+			return nil, fmt.Errorf("DWARF has no struct %s", m.Type)
+		}
+		offset, err := memberOffset(st, m.Member)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Type, err)
+		}
+		found[m] = offset
+	}
+	return found, nil
+}
+
+// memberOffset walks a dot-separated member path through nested structs
+func memberOffset(st *dwarf.StructType, path string) (uint64, error) {
+	var offset uint64
+
+	for part := range strings.SplitSeq(path, ".") {
+		if st == nil {
+			return 0, fmt.Errorf("%s: %s is not a struct", path, part)
+		}
+
+		var field *dwarf.StructField
+		for _, f := range st.Field {
+			if f.Name == part {
+				field = f
+				break
+			}
+		}
+		if field == nil {
+			return 0, fmt.Errorf("no member %s", path)
+		}
+
+		offset += uint64(field.ByteOffset)
+		st = asStruct(field.Type)
+	}
+
+	return offset, nil
+}
+
+// asStruct resolves typedefs and returns the underlying struct, or nil
+func asStruct(typ dwarf.Type) *dwarf.StructType {
+	for {
+		switch t := typ.(type) {
+		case *dwarf.TypedefType:
+			typ = t.Type
+		case *dwarf.StructType:
+			return t
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// FuncEvent mirrors struct func_event in monitoring.c
+type FuncEvent struct {
+	Timestamp uint64
+	LatencyNs uint64
+	FuncID    uint64
+	ProcessId uint32
+	ThreadId  uint32
+}
+
+// funcEventSize is the size of struct func_event without its trailing padding
+const funcEventSize = 32
+
+// Decode fills e from a raw little-endian struct func_event without allocating
+func (e *FuncEvent) Decode(raw []byte) error {
+	if len(raw) < funcEventSize {
+		return errShortEvent
+	}
+
+	le := binary.LittleEndian
+	e.Timestamp = le.Uint64(raw[0:])
+	e.LatencyNs = le.Uint64(raw[8:])
+	e.FuncID = le.Uint64(raw[16:])
+	e.ProcessId = le.Uint32(raw[24:])
+	e.ThreadId = le.Uint32(raw[28:])
+	return nil
+}
+
+// TraceTarget is a binary:symbol pair whose duration is measured
+type TraceTarget struct {
+	ID     uint64 // passed to the BPF programs as attach cookie
+	Binary string
+	Symbol string
+}
+
+// Label returns the series label used for this target's metrics
+func (t TraceTarget) Label() string {
+	return filepath.Base(t.Binary) + ":" + t.Symbol
+}
+
+// ParseTraceTarget parses a "binary:symbol" specification
+func ParseTraceTarget(spec string) (TraceTarget, error) {
+	sep := strings.LastIndex(spec, ":")
+	if sep <= 0 || sep == len(spec)-1 {
+		return TraceTarget{}, fmt.Errorf("invalid trace target %q, expected binary:symbol", spec)
+	}
+	return TraceTarget{Binary: spec[:sep], Symbol: spec[sep+1:]}, nil
+}
+
+// traceFlags collects repeated -trace flags
+type traceFlags []string
+
+func (tf *traceFlags) String() string {
+	return strings.Join(*tf, ",")
+}
+
+func (tf *traceFlags) Set(value string) error {
+	*tf = append(*tf, value)
+	return nil
+}
+
+// FunctionTracer attaches an entry uprobe and a uretprobe to every traced
+// function. Durations are keyed by thread ID in the kernel.
+type FunctionTracer struct {
+	targets []TraceTarget
+	links   []link.Link
+}
+
+// NewFunctionTracer creates a new FunctionTracer, assigning each target its ID
+func NewFunctionTracer(targets []TraceTarget) *FunctionTracer {
+	for i := range targets {
+		targets[i].ID = uint64(i)
+	}
+	return &FunctionTracer{targets: targets}
+}
+
+// Targets returns the traced functions indexed by their ID
+func (ft *FunctionTracer) Targets() []TraceTarget {
+	return ft.targets
+}
+
+// Attach attaches the entry and exit programs to every target
+func (ft *FunctionTracer) Attach(entry, exit *ebpf.Program) error {
+	executables := make(map[string]*link.Executable)
+
+	for _, target := range ft.targets {
+		executable, ok := executables[target.Binary]
+		if !ok {
+			var err error
+			executable, err = link.OpenExecutable(target.Binary)
+			if err != nil {
+				return fmt.Errorf("opening executable %s: %w", target.Binary, err)
+			}
+			executables[target.Binary] = executable
+		}
+
+		opts := &link.UprobeOptions{Cookie: target.ID}
+
+		entryLink, err := executable.Uprobe(target.Symbol, entry, opts)
+		if err != nil {
+			return fmt.Errorf("opening uprobe '%s': %w", target.Label(), err)
+		}
+		ft.links = append(ft.links, entryLink)
+
+		exitLink, err := executable.Uretprobe(target.Symbol, exit, opts)
+		if err != nil {
+			return fmt.Errorf("opening uretprobe '%s': %w", target.Label(), err)
+		}
+		ft.links = append(ft.links, exitLink)
+
+		log.Printf("Tracing %s (series %q)", target.Symbol, target.Label())
+	}
+
+	return nil
+}
+
+// Close detaches all probes
+func (ft *FunctionTracer) Close() error {
+	return closeLinks(ft.links)
+}
@@ -5,7 +5,8 @@ go 1.25.5
 tool github.com/cilium/ebpf/cmd/bpf2go
 
 require (
-	github.com/cilium/ebpf v0.20.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
-	golang.org/x/sys v0.37.0 // indirect
+	github.com/cilium/ebpf v0.20.0
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/arch v0.22.0
+	golang.org/x/sys v0.37.0
 )
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"debug/buildinfo"
+	"debug/elf"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// goServeHTTPSymbol is the function every net/http server request passes through
+const goServeHTTPSymbol = "net/http.serverHandler.ServeHTTP"
+
+// goOffsets mirrors struct go_offsets in monitoring.c
+type goOffsets = trazor_agentGoOffsets
+
+// newestGoMinor is the newest Go release whose runtime.g layout is known
+const newestGoMinor = 25
+
+// defaultGoOffsets returns the offsets for binaries built without DWARF
+// (-ldflags=-w), based on the Go version that built them. Request.URL and
+// URL.Path have been stable for many releases; runtime.g grew syscallbp in
+// Go 1.23 and lost gobuf.ret in Go 1.25. Newer releases are refused rather
+// than guessed, since a wrong goid offset silently mismatches every request.
+func defaultGoOffsets(goVersion string) (goOffsets, error) {
+	minor, err := goMinorVersion(goVersion)
+	if err != nil {
+		return goOffsets{}, err
+	}
+	if minor < 21 {
+		return goOffsets{}, fmt.Errorf("unsupported Go version %s", goVersion)
+	}
+	if minor > newestGoMinor {
+		return goOffsets{}, fmt.Errorf("no default offsets for Go version %s newer than go1.%d, build without -ldflags=-w", goVersion, newestGoMinor)
+	}
+
+	offsets := goOffsets{Goid: 152, RequestUrl: 16, UrlPath: 56}
+	if minor == 23 || minor == 24 {
+		offsets.Goid = 160
+	}
+	return offsets, nil
+}
+
+// goMinorVersion extracts the minor version from strings like "go1.22.5"
+func goMinorVersion(goVersion string) (int, error) {
+	version, ok := strings.CutPrefix(goVersion, "go1.")
+	if !ok {
+		return 0, fmt.Errorf("unrecognized Go version %q", goVersion)
+	}
+	if end := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+		version = version[:end]
+	}
+	return strconv.Atoi(version)
+}
+
+// GoHTTPProbe attaches entry and return-offset uprobes to net/http servers
+type GoHTTPProbe struct {
+	binary string
+	links  []link.Link
+}
+
+// NewGoHTTPProbe creates a new GoHTTPProbe for the Go executable at binary
+func NewGoHTTPProbe(binary string) *GoHTTPProbe {
+	return &GoHTTPProbe{binary: binary}
+}
+
+// Attach resolves struct offsets, stores them under the attach cookie and
+// attaches start at the function entry and end at every RET instruction
+func (gp *GoHTTPProbe) Attach(start, end *ebpf.Program, offsetsMap *ebpf.Map) error {
+	const cookie = uint64(0)
+
+	f, err := elf.Open(gp.binary)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if f.Machine != elf.EM_X86_64 {
+		return fmt.Errorf("%s: Go probes only support amd64, got %s", gp.binary, f.Machine)
+	}
+
+	offsets, err := resolveGoOffsets(f)
+	if err != nil {
+		info, infoErr := buildinfo.ReadFile(gp.binary)
+		if infoErr != nil {
+			return fmt.Errorf("resolving Go struct offsets: %v, reading build info: %w", err, infoErr)
+		}
+		log.Printf("Resolving Go struct offsets from DWARF: %v (using defaults for %s)", err, info.GoVersion)
+		if offsets, err = defaultGoOffsets(info.GoVersion); err != nil {
+			return err
+		}
+	}
+	if err := offsetsMap.Put(cookie, offsets); err != nil {
+		return fmt.Errorf("storing Go offsets: %w", err)
+	}
+
+	returns, err := findReturnOffsets(f, goServeHTTPSymbol)
+	if err != nil {
+		return err
+	}
+
+	executable, err := link.OpenExecutable(gp.binary)
+	if err != nil {
+		return fmt.Errorf("opening executable: %w", err)
+	}
+
+	l, err := executable.Uprobe(goServeHTTPSymbol, start, &link.UprobeOptions{Cookie: cookie})
+	if err != nil {
+		return fmt.Errorf("opening uprobe '%s': %w", goServeHTTPSymbol, err)
+	}
+	gp.links = append(gp.links, l)
+
+	for _, offset := range returns {
+		l, err := executable.Uprobe(goServeHTTPSymbol, end, &link.UprobeOptions{Offset: offset, Cookie: cookie})
+		if err != nil {
+			return fmt.Errorf("opening uprobe '%s+%#x': %w", goServeHTTPSymbol, offset, err)
+		}
+		gp.links = append(gp.links, l)
+	}
+
+	log.Printf("Attached Go net/http probes to %s (%d return sites, goid offset %d)",
+		gp.binary, len(returns), offsets.Goid)
+	return nil
+}
+
+// Close detaches all probes
+func (gp *GoHTTPProbe) Close() error {
+	return closeLinks(gp.links)
+}
+
+// findReturnOffsets disassembles symbol and returns the offsets of its RET
+// instructions relative to the start of the function
+func findReturnOffsets(f *elf.File, symbol string) ([]uint64, error) {
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("reading symbols: %w", err)
+	}
+
+	var sym *elf.Symbol
+	for i := range syms {
+		if syms[i].Name == symbol && elf.ST_TYPE(syms[i].Info) == elf.STT_FUNC {
+			sym = &syms[i]
+			break
+		}
+	}
+	if sym == nil || sym.Size == 0 {
+		return nil, fmt.Errorf("symbol %s not found", symbol)
+	}
+
+	text := f.Section(".text")
+	if text == nil || sym.Value < text.Addr || sym.Value+sym.Size > text.Addr+text.Size {
+		return nil, fmt.Errorf("symbol %s is outside .text", symbol)
+	}
+
+	code := make([]byte, sym.Size)
+	if _, err := text.ReadAt(code, int64(sym.Value-text.Addr)); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", symbol, err)
+	}
+
+	var offsets []uint64
+	for pc := 0; pc < len(code); {
+		inst, err := x86asm.Decode(code[pc:], 64)
+		if err != nil {
+			// skip undecodable bytes such as alignment padding
+			pc++
+			continue
+		}
+		if inst.Op == x86asm.RET {
+			offsets = append(offsets, uint64(pc))
+		}
+		pc += inst.Len
+	}
+
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("no RET instructions found in %s", symbol)
+	}
+	return offsets, nil
+}
+
+// resolveGoOffsets reads the struct member offsets needed by the Go probes from DWARF
+func resolveGoOffsets(f *elf.File) (goOffsets, error) {
+	data, err := f.DWARF()
+	if err != nil {
+		return goOffsets{}, err
+	}
+
+	goid := dwarfMember{Type: "runtime.g", Member: "goid"}
+	requestURL := dwarfMember{Type: "net/http.Request", Member: "URL"}
+	urlPath := dwarfMember{Type: "net/url.URL", Member: "Path"}
+
+	found, err := dwarfMemberOffsets(data, []dwarfMember{goid, requestURL, urlPath})
+	if err != nil {
+		return goOffsets{}, err
+	}
+
+	return goOffsets{
+		Goid:       found[goid],
+		RequestUrl: found[requestURL],
+		UrlPath:    found[urlPath],
+	}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// AgentHealth is the state of the agent at the end of a window. With heartbeats
+// enabled it is attached to every window, including the ones without traffic,
+// so the collector can tell an idle service from a stalled agent.
+type AgentHealth struct {
+	UptimeSeconds       float64 `json:"uptime_seconds"`
+	AttachedProbes      int     `json:"attached_probes"`       // binaries or functions with probes attached
+	RingbufPendingBytes int     `json:"ringbuf_pending_bytes"` // events not read by the agent yet
+	RingbufSize         int     `json:"ringbuf_size"`
+	Goroutines          int     `json:"goroutines"`
+	HeapBytes           uint64  `json:"heap_bytes"`
+}
+
+// HealthMonitor collects AgentHealth
+type HealthMonitor struct {
+	startedAt time.Time
+	ringBuf   *ringbuf.Reader
+	attached  func() int // number of attached probes of the current mode
+}
+
+// NewHealthMonitor creates a new HealthMonitor. ringBuf may be nil.
+func NewHealthMonitor(ringBuf *ringbuf.Reader, attached func() int) *HealthMonitor {
+	return &HealthMonitor{
+		startedAt: time.Now(),
+		ringBuf:   ringBuf,
+		attached:  attached,
+	}
+}
+
+// Collect returns the current health of the agent
+func (hm *HealthMonitor) Collect() *AgentHealth {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	health := &AgentHealth{
+		UptimeSeconds:  time.Since(hm.startedAt).Seconds(),
+		AttachedProbes: hm.attached(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapBytes:      memStats.HeapAlloc,
+	}
+	if hm.ringBuf != nil {
+		health.RingbufPendingBytes = hm.ringBuf.AvailableBytes()
+		health.RingbufSize = hm.ringBuf.BufferSize()
+	}
+	return health
+}
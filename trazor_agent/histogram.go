@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HistogramLayout is the set of latency bucket upper bounds of a histogram
+type HistogramLayout struct {
+	name     string
+	bounds   []uint64 // inclusive upper bounds in microseconds, increasing
+	boundsNs []uint64 // the same bounds in nanoseconds, for bucketing raw latencies
+}
+
+// prometheusBounds are the Prometheus client default buckets (5ms to 10s) in microseconds
+var prometheusBounds = []uint64{5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000, 2500000, 5000000, 10000000}
+
+// newHistogramLayout validates bounds and creates a layout
+func newHistogramLayout(name string, bounds []uint64) (*HistogramLayout, error) {
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("histogram layout %s has no buckets", name)
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("histogram layout %s: bounds must increase, got %d after %d", name, bounds[i], bounds[i-1])
+		}
+	}
+
+	boundsNs := make([]uint64, len(bounds))
+	for i, bound := range bounds {
+		boundsNs[i] = bound * 1000
+	}
+	return &HistogramLayout{name: name, bounds: bounds, boundsNs: boundsNs}, nil
+}
+
+// ExplicitLayout creates a layout from explicit upper bounds in microseconds, like Prometheus buckets
+func ExplicitLayout(bounds []uint64) (*HistogramLayout, error) {
+	return newHistogramLayout("explicit", bounds)
+}
+
+// ExponentialLayout creates count buckets whose bounds start at start microseconds
+// and grow by factor, e.g. 100µs, 200µs, 400µs, ... for factor 2
+func ExponentialLayout(start uint64, factor float64, count int) (*HistogramLayout, error) {
+	if start == 0 || factor <= 1 || count <= 0 {
+		return nil, fmt.Errorf("exponential layout needs start > 0, factor > 1 and count > 0")
+	}
+
+	bounds := make([]uint64, 0, count)
+	bound := float64(start)
+	for range count {
+		// rounding can merge the first few small bounds, keep them increasing
+		next := uint64(math.Round(bound))
+		if len(bounds) > 0 && next <= bounds[len(bounds)-1] {
+			next = bounds[len(bounds)-1] + 1
+		}
+		bounds = append(bounds, next)
+		bound *= factor
+	}
+	return newHistogramLayout("exponential", bounds)
+}
+
+// LogLinearLayout creates HDR-style buckets from lowest to highest microseconds:
+// every power-of-two range is split into subBuckets linear buckets, which bounds
+// the relative bucket width to 1/subBuckets at every magnitude
+func LogLinearLayout(lowest, highest uint64, subBuckets int) (*HistogramLayout, error) {
+	if lowest == 0 || highest <= lowest || subBuckets <= 0 {
+		return nil, fmt.Errorf("log-linear layout needs 0 < lowest < highest and subBuckets > 0")
+	}
+
+	bounds := []uint64{lowest}
+	for base := lowest; bounds[len(bounds)-1] < highest; base *= 2 {
+		for i := 1; i <= subBuckets && bounds[len(bounds)-1] < highest; i++ {
+			bound := base + base*uint64(i)/uint64(subBuckets)
+			if bound > bounds[len(bounds)-1] {
+				bounds = append(bounds, bound)
+			}
+		}
+	}
+	return newHistogramLayout("log-linear", bounds)
+}
+
+// ParseHistogramLayout parses a layout specification:
+//
+//	prometheus                            Prometheus default buckets, 5ms to 10s
+//	explicit:100,250,500,1000             upper bounds in microseconds
+//	exponential:<start>,<factor>,<count>  e.g. exponential:100,2,16
+//	log-linear:<lowest>,<highest>,<sub>   e.g. log-linear:10,10000000,4
+//
+// "none" disables the histogram and returns nil.
+func ParseHistogramLayout(spec string) (*HistogramLayout, error) {
+	kind, args, _ := strings.Cut(spec, ":")
+	var fields []string
+	if args != "" {
+		fields = strings.Split(args, ",")
+	}
+
+	switch kind {
+	case "none":
+		return nil, nil
+	case "prometheus":
+		return newHistogramLayout("prometheus", prometheusBounds)
+	case "explicit":
+		bounds := make([]uint64, len(fields))
+		for i, field := range fields {
+			bound, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid histogram bound %q", field)
+			}
+			bounds[i] = bound
+		}
+		return ExplicitLayout(bounds)
+	case "exponential", "log-linear":
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s layout needs three parameters, got %q", kind, args)
+		}
+		first, err1 := strconv.ParseUint(fields[0], 10, 64)
+		if kind == "exponential" {
+			factor, err2 := strconv.ParseFloat(fields[1], 64)
+			count, err3 := strconv.Atoi(fields[2])
+			if err1 != nil || err2 != nil || err3 != nil {
+				return nil, fmt.Errorf("invalid exponential layout %q", args)
+			}
+			return ExponentialLayout(first, factor, count)
+		}
+		highest, err2 := strconv.ParseUint(fields[1], 10, 64)
+		subBuckets, err3 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("invalid log-linear layout %q", args)
+		}
+		return LogLinearLayout(first, highest, subBuckets)
+	}
+	return nil, fmt.Errorf("unknown histogram layout %q, expected none, prometheus, explicit, exponential or log-linear", kind)
+}
+
+// Bounds returns the inclusive bucket upper bounds in microseconds
+func (l *HistogramLayout) Bounds() []uint64 {
+	return l.bounds
+}
+
+// LatencyHistogram counts the requests of a window per latency bucket. Counts are
+// not cumulative: Counts[i] holds the requests above Bounds[i-1] and at most
+// Bounds[i], the extra last count holds the requests above the highest bound.
+// Histograms with the same layout can be summed across windows and agents.
+type LatencyHistogram struct {
+	Layout string   `json:"layout"`
+	Bounds []uint64 `json:"bounds_us"`
+	Counts []uint64 `json:"counts"`
+
+	boundsNs []uint64
+}
+
+// NewLatencyHistogram creates an empty histogram with the given layout
+func NewLatencyHistogram(layout *HistogramLayout) *LatencyHistogram {
+	return &LatencyHistogram{
+		Layout:   layout.name,
+		Bounds:   layout.bounds,
+		Counts:   make([]uint64, len(layout.bounds)+1),
+		boundsNs: layout.boundsNs,
+	}
+}
+
+// Add counts weight requests with the given latency in nanoseconds
+func (h *LatencyHistogram) Add(latencyNs, weight uint64) {
+	h.Counts[lowerBound(h.boundsNs, latencyNs)] += weight
+}
+
+// lowerBound returns the index of the first bound at or above value, len(bounds)
+// if there is none. Unlike slices.BinarySearch, the loop body compiles to a
+// conditional move, random latencies do not cause branch mispredictions.
+func lowerBound(bounds []uint64, value uint64) int {
+	base, n := 0, len(bounds)
+	for n > 1 {
+		half := n / 2
+		if bounds[base+half-1] < value {
+			base += half
+		}
+		n -= half
+	}
+	if n == 1 && bounds[base] < value {
+		base++
+	}
+	return base
+}
+
+// Merge adds the counts of other, which must have the same bounds
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) error {
+	if !slices.Equal(h.Bounds, other.Bounds) {
+		return fmt.Errorf("merging %s histogram into %s histogram with different bounds", other.Layout, h.Layout)
+	}
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	return nil
+}
+
+// Total returns the number of requests counted in the histogram
+func (h *LatencyHistogram) Total() uint64 {
+	var total uint64
+	for _, count := range h.Counts {
+		total += count
+	}
+	return total
+}
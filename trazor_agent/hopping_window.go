@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HoppingWindowConfig describes a window of Size emitted every Hop
+type HoppingWindowConfig struct {
+	Size time.Duration
+	Hop  time.Duration
+}
+
+// ParseHoppingWindows parses a comma-separated list of hopping windows such as
+// "1m,5m/30s": a window size, optionally followed by its hop, which defaults to
+// the base window. Both must be multiples of the base window.
+func ParseHoppingWindows(list string, window time.Duration) ([]HoppingWindowConfig, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var configs []HoppingWindowConfig
+	for field := range strings.SplitSeq(list, ",") {
+		sizeField, hopField, hasHop := strings.Cut(strings.TrimSpace(field), "/")
+
+		config := HoppingWindowConfig{Hop: window}
+		var err error
+		if config.Size, err = time.ParseDuration(sizeField); err != nil {
+			return nil, fmt.Errorf("invalid hopping window size %q", sizeField)
+		}
+		if hasHop {
+			if config.Hop, err = time.ParseDuration(hopField); err != nil {
+				return nil, fmt.Errorf("invalid hopping window hop %q", hopField)
+			}
+		}
+
+		if config.Hop <= 0 || config.Hop%window != 0 || config.Size%window != 0 {
+			return nil, fmt.Errorf("hopping window %s: size and hop must be multiples of %v", field, window)
+		}
+		if config.Size <= config.Hop {
+			return nil, fmt.Errorf("hopping window %s: size must be larger than the hop", field)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// hoppingWindow keeps the metrics of the last sub-windows in a ring and merges
+// them into one window of the full size at every hop. Only the mergeable state
+// of each sub-window is kept, never its raw samples.
+type hoppingWindow struct {
+	config HoppingWindowConfig
+	window time.Duration    // sub-window length
+	ring   []*WindowMetrics // sub-window metrics, nil for windows without samples
+	next   int              // ring slot of the next sub-window
+	filled int              // ring slots holding a sub-window, until the ring is full
+}
+
+// newHoppingWindow creates a hoppingWindow built from sub-windows of length window
+func newHoppingWindow(config HoppingWindowConfig, window time.Duration) *hoppingWindow {
+	return &hoppingWindow{
+		config: config,
+		window: window,
+		ring:   make([]*WindowMetrics, config.Size/window),
+	}
+}
+
+// add stores the metrics of the sub-window ending at end, replacing the oldest
+// one, and returns the merged window if a hop ends with it
+func (hw *hoppingWindow) add(metrics *WindowMetrics, end int64, percentiles []float64) *WindowMetrics {
+	hw.ring[hw.next] = metrics
+	hw.next = (hw.next + 1) % len(hw.ring)
+	hw.filled = min(hw.filled+1, len(hw.ring))
+
+	if end%int64(hw.config.Hop) != 0 {
+		return nil
+	}
+
+	merged := &rollup{resolution: hw.config.Size}
+	for _, subWindow := range hw.ring {
+		if subWindow != nil {
+			merged.add(subWindow)
+		}
+	}
+
+	result := merged.close(end, percentiles)
+	if result != nil {
+		// the ring covers the sub-windows ending now, not an aligned rollup window,
+		// and less than the size until it is full after startup
+		covered := time.Duration(hw.filled) * hw.window
+		result.WindowStart = end - int64(covered)
+		result.RequestThroughput = float64(result.RequestBytes) / covered.Seconds()
+		result.ResponseThroughput = float64(result.ResponseBytes) / covered.Seconds()
+		result.Hop = formatResolution(hw.config.Hop)
+	}
+	return result
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleCgroupWindows is the number of windows a cgroup is still followed
+// after its last request, so its throttling deltas keep covering one window
+const maxIdleCgroupWindows = 6
+
+// pressureResources are the resources reported by /proc/pressure
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// HostSnapshot is the state of the host during a window. Utilization, stall and
+// throttling figures cover the whole window, the load averages are read at its
+// end.
+type HostSnapshot struct {
+	CPUs           int                       `json:"cpus"`
+	CPUUtilization float64                   `json:"cpu_utilization"` // busy share of all CPUs, 0 to 1
+	CPUIOWait      float64                   `json:"cpu_iowait"`      // idle share waiting for I/O
+	CPUSteal       float64                   `json:"cpu_steal"`       // share taken by the hypervisor
+	Load1          float64                   `json:"load1"`
+	Load5          float64                   `json:"load5"`
+	Load15         float64                   `json:"load15"`
+	Pressure       map[string]*PressureStall `json:"pressure,omitempty"` // "cpu", "memory" and "io", without PSI support empty
+	Cgroups        []*CgroupThrottling       `json:"cgroups,omitempty"`  // cgroups of the processes that served requests
+}
+
+// PressureStall is the pressure stall information of one resource: the share of
+// time at least one task (some) or all non-idle tasks (full) were stalled on it
+type PressureStall struct {
+	Some      float64 `json:"some"`       // during the window, 0 to 1
+	Full      float64 `json:"full"`       // during the window, 0 to 1
+	SomeAvg10 float64 `json:"some_avg10"` // kernel 10-second average in percent, at the end of the window
+	FullAvg10 float64 `json:"full_avg10"`
+}
+
+// CgroupThrottling is the CPU bandwidth throttling of a cgroup during the window
+type CgroupThrottling struct {
+	Cgroup           string `json:"cgroup"`
+	Periods          uint64 `json:"periods"`           // enforcement periods with runnable tasks
+	ThrottledPeriods uint64 `json:"throttled_periods"` // periods in which the quota ran out
+	ThrottledUs      uint64 `json:"throttled_us"`      // time the cgroup's tasks were throttled
+	UsageUs          uint64 `json:"usage_us"`          // CPU time used, 0 on cgroup v1
+}
+
+// cpuTimes are the jiffies of the aggregate cpu line of /proc/stat
+type cpuTimes struct {
+	busy, iowait, steal, total uint64
+}
+
+// pressureTotals are the cumulative stall times of a resource in µs
+type pressureTotals struct {
+	some, full           uint64
+	someAvg10, fullAvg10 float64
+}
+
+// cgroupStat is a reading of the cpu.stat of a cgroup
+type cgroupStat struct {
+	periods, throttledPeriods, throttledUs, usageUs uint64
+}
+
+// trackedCgroup is a cgroup whose cpu.stat is read at every window
+type trackedCgroup struct {
+	last     cgroupStat
+	idle     int               // windows since the last request served from the cgroup
+	throttle *CgroupThrottling // delta of the current window, nil before the second reading
+}
+
+// HostMonitor collects a HostSnapshot at the end of every window. Aggregators
+// sharing it get the same snapshot for the same window.
+type HostMonitor struct {
+	mutex      sync.Mutex
+	procRoot   string
+	cgroupRoot string
+	now        func() time.Time
+
+	end      int64 // window of the cached snapshot
+	snapshot HostSnapshot
+
+	lastTime     time.Time
+	lastCPU      cpuTimes
+	lastPressure map[string]pressureTotals
+	cgroups      map[string]*trackedCgroup // by cgroup path, e.g. "/system.slice/nginx.service"
+	pidCgroups   map[uint32]string
+}
+
+// NewHostMonitor creates a HostMonitor reading /proc and /sys/fs/cgroup
+func NewHostMonitor() *HostMonitor {
+	return newHostMonitor("/proc", "/sys/fs/cgroup", time.Now)
+}
+
+// newHostMonitor creates a HostMonitor reading the given roots, taking the
+// baseline of the first window
+func newHostMonitor(procRoot, cgroupRoot string, now func() time.Time) *HostMonitor {
+	hm := &HostMonitor{
+		procRoot:   procRoot,
+		cgroupRoot: cgroupRoot,
+		now:        now,
+		cgroups:    make(map[string]*trackedCgroup),
+		pidCgroups: make(map[uint32]string),
+	}
+	hm.lastTime = now()
+	hm.lastCPU, _ = hm.readCPUTimes()
+	hm.lastPressure = hm.readPressure()
+	return hm
+}
+
+// Collect returns the snapshot of the window ending at end, for the cgroups of
+// the processes that served its requests. The first call for a window reads
+// the host; later ones, by aggregators of other series, add their cgroups.
+func (hm *HostMonitor) Collect(end int64, pids []uint32) *HostSnapshot {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	if end != hm.end {
+		hm.end = end
+		hm.collectHost()
+	}
+
+	snapshot := hm.snapshot
+	snapshot.Cgroups = nil
+	for _, pid := range pids {
+		path, ok := hm.pidCgroups[pid]
+		if !ok {
+			path = hm.readCgroupPath(pid)
+			hm.pidCgroups[pid] = path
+		}
+		if path == "" {
+			continue
+		}
+
+		cgroup, ok := hm.cgroups[path]
+		if !ok {
+			// the baseline; throttling is reported from the next window on
+			cgroup = &trackedCgroup{}
+			cgroup.last, _ = hm.readCgroupStat(path)
+			hm.cgroups[path] = cgroup
+		}
+		cgroup.idle = 0
+		if cgroup.throttle != nil && !slices.Contains(snapshot.Cgroups, cgroup.throttle) {
+			snapshot.Cgroups = append(snapshot.Cgroups, cgroup.throttle)
+		}
+	}
+	slices.SortFunc(snapshot.Cgroups, func(a, b *CgroupThrottling) int {
+		return strings.Compare(a.Cgroup, b.Cgroup)
+	})
+	return &snapshot
+}
+
+// collectHost reads the host counters and the tracked cgroups for a new window
+func (hm *HostMonitor) collectHost() {
+	now := hm.now()
+	elapsedUs := float64(now.Sub(hm.lastTime).Microseconds())
+	hm.lastTime = now
+
+	snapshot := HostSnapshot{Pressure: make(map[string]*PressureStall)}
+
+	if cpu, err := hm.readCPUTimes(); err == nil {
+		if cpu.total > hm.lastCPU.total {
+			total := float64(cpu.total - hm.lastCPU.total)
+			snapshot.CPUUtilization = float64(cpu.busy-hm.lastCPU.busy) / total
+			snapshot.CPUIOWait = float64(cpu.iowait-hm.lastCPU.iowait) / total
+			snapshot.CPUSteal = float64(cpu.steal-hm.lastCPU.steal) / total
+		}
+		hm.lastCPU = cpu
+	}
+	snapshot.CPUs = hm.countCPUs()
+	snapshot.Load1, snapshot.Load5, snapshot.Load15 = hm.readLoadAvg()
+
+	pressure := hm.readPressure()
+	for resource, totals := range pressure {
+		stall := &PressureStall{SomeAvg10: totals.someAvg10, FullAvg10: totals.fullAvg10}
+		if last, ok := hm.lastPressure[resource]; ok && elapsedUs > 0 {
+			stall.Some = min(float64(totals.some-last.some)/elapsedUs, 1)
+			stall.Full = min(float64(totals.full-last.full)/elapsedUs, 1)
+		}
+		snapshot.Pressure[resource] = stall
+	}
+	hm.lastPressure = pressure
+
+	// every tracked cgroup is read each window, so its deltas cover exactly one
+	for path, cgroup := range hm.cgroups {
+		cgroup.idle++
+		if cgroup.idle > maxIdleCgroupWindows {
+			delete(hm.cgroups, path)
+			continue
+		}
+
+		stat, err := hm.readCgroupStat(path)
+		if err != nil {
+			delete(hm.cgroups, path)
+			continue
+		}
+		cgroup.throttle = &CgroupThrottling{
+			Cgroup:           path,
+			Periods:          stat.periods - min(cgroup.last.periods, stat.periods),
+			ThrottledPeriods: stat.throttledPeriods - min(cgroup.last.throttledPeriods, stat.throttledPeriods),
+			ThrottledUs:      stat.throttledUs - min(cgroup.last.throttledUs, stat.throttledUs),
+			UsageUs:          stat.usageUs - min(cgroup.last.usageUs, stat.usageUs),
+		}
+		cgroup.last = stat
+	}
+
+	// workers come and go, their cgroups are looked up again
+	clear(hm.pidCgroups)
+	hm.snapshot = snapshot
+}
+
+// readCPUTimes reads the aggregate cpu line of /proc/stat
+func (hm *HostMonitor) readCPUTimes() (cpuTimes, error) {
+	f, err := os.Open(filepath.Join(hm.procRoot, "stat"))
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return cpuTimes{}, fmt.Errorf("empty /proc/stat")
+	}
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return cpuTimes{}, fmt.Errorf("unexpected /proc/stat line %q", scanner.Text())
+	}
+
+	var jiffies [8]uint64
+	for i := range jiffies {
+		jiffies[i], _ = strconv.ParseUint(fields[i+1], 10, 64)
+	}
+	// guest time is already part of user time
+	var times cpuTimes
+	for _, j := range jiffies {
+		times.total += j
+	}
+	times.iowait = jiffies[4]
+	times.steal = jiffies[7]
+	times.busy = times.total - jiffies[3] - jiffies[4]
+	return times, nil
+}
+
+// countCPUs counts the per-CPU lines of /proc/stat
+func (hm *HostMonitor) countCPUs() int {
+	f, err := os.Open(filepath.Join(hm.procRoot, "stat"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	cpus := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "cpu") && len(line) > 3 && line[3] >= '0' && line[3] <= '9' {
+			cpus++
+		}
+	}
+	return cpus
+}
+
+// readLoadAvg reads the 1, 5 and 15 minute load averages
+func (hm *HostMonitor) readLoadAvg() (load1, load5, load15 float64) {
+	data, err := os.ReadFile(filepath.Join(hm.procRoot, "loadavg"))
+	if err != nil {
+		return 0, 0, 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return 0, 0, 0
+	}
+	load1, _ = strconv.ParseFloat(fields[0], 64)
+	load5, _ = strconv.ParseFloat(fields[1], 64)
+	load15, _ = strconv.ParseFloat(fields[2], 64)
+	return load1, load5, load15
+}
+
+// readPressure reads /proc/pressure, empty on kernels without PSI
+func (hm *HostMonitor) readPressure() map[string]pressureTotals {
+	pressure := make(map[string]pressureTotals)
+	for _, resource := range pressureResources {
+		data, err := os.ReadFile(filepath.Join(hm.procRoot, "pressure", resource))
+		if err != nil {
+			continue
+		}
+
+		// some avg10=0.21 avg60=1.55 avg300=1.83 total=93120609
+		var totals pressureTotals
+		for line := range strings.Lines(string(data)) {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			var avg10 float64
+			var total uint64
+			for _, field := range fields[1:] {
+				key, value, _ := strings.Cut(field, "=")
+				switch key {
+				case "avg10":
+					avg10, _ = strconv.ParseFloat(value, 64)
+				case "total":
+					total, _ = strconv.ParseUint(value, 10, 64)
+				}
+			}
+			switch fields[0] {
+			case "some":
+				totals.some, totals.someAvg10 = total, avg10
+			case "full":
+				totals.full, totals.fullAvg10 = total, avg10
+			}
+		}
+		pressure[resource] = totals
+	}
+	return pressure
+}
+
+// readCgroupPath returns the cgroup of a process holding its CPU controller:
+// "cpu:<path>" in the v1 cpu hierarchy if it is mounted, else the path in the
+// unified hierarchy. It returns "" for exited processes.
+func (hm *HostMonitor) readCgroupPath(pid uint32) string {
+	data, err := os.ReadFile(filepath.Join(hm.procRoot, strconv.FormatUint(uint64(pid), 10), "cgroup"))
+	if err != nil {
+		return ""
+	}
+
+	unified := ""
+	for line := range strings.Lines(string(data)) {
+		// hierarchy-ID:controllers:path
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			unified = fields[2]
+			continue
+		}
+		if slices.Contains(strings.Split(fields[1], ","), "cpu") {
+			return "cpu:" + fields[2]
+		}
+	}
+	return unified
+}
+
+// readCgroupStat reads the cpu.stat of a cgroup path from readCgroupPath
+func (hm *HostMonitor) readCgroupStat(path string) (cgroupStat, error) {
+	dir := filepath.Join(hm.cgroupRoot, path)
+	if v1Path, ok := strings.CutPrefix(path, "cpu:"); ok {
+		dir = filepath.Join(hm.cgroupRoot, "cpu", v1Path)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return cgroupStat{}, err
+	}
+
+	var stat cgroupStat
+	for line := range strings.Lines(string(data)) {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		n, _ := strconv.ParseUint(value, 10, 64)
+		switch key {
+		case "nr_periods":
+			stat.periods = n
+		case "nr_throttled":
+			stat.throttledPeriods = n
+		case "throttled_usec": // v2
+			stat.throttledUs = n
+		case "throttled_time": // v1, in ns
+			stat.throttledUs = n / 1000
+		case "usage_usec":
+			stat.usageUs = n
+		}
+	}
+	return stat, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// bootTime is the wall-clock time of CLOCK_MONOTONIC zero in nanoseconds, the
+// clock bpf_ktime_get_ns() reads
+var bootTime = sync.OnceValue(func() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return time.Now().UnixNano() - ts.Nano()
+})
+
+// ktimeToWall converts a bpf_ktime_get_ns() timestamp to Unix nanoseconds
+func ktimeToWall(ktime uint64) int64 {
+	return bootTime() + int64(ktime)
+}
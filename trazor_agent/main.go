@@ -3,25 +3,108 @@ package main
 //go:generate go tool bpf2go -tags linux trazor_agent monitoring.c
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/ringbuf"
 	"github.com/cilium/ebpf/rlimit"
 )
 
 type HttpEvent struct {
-	Timestamp uint64
-	LatencyNs uint64
-	ProcessId uint32
+	Timestamp      uint64
+	LatencyNs      uint64
+	TTFBNs         uint64 // time until the response header was sent, 0 if unknown
+	UpstreamNs     uint64 // time spent in proxy_pass upstreams, 0 if not proxied
+	RequestBytes   uint64 // request body size from Content-Length, 0 if unknown
+	BytesSent      uint64 // response bytes written to the connection
+	CPUNs          uint64 // time the serving thread spent on-CPU, 0 if unknown
+	RunQueueNs     uint64 // time it was runnable but waiting for a CPU
+	BlockedNs      uint64 // time it was sleeping, e.g. in epoll_wait or on disk I/O
+	ProcessId      uint32
+	SampleRate     uint32 // 1-in-N rate the event was sampled at
+	Status         uint16 // final HTTP status, 0 if unknown
+	UpstreamFamily uint16
+	UpstreamPort   uint16
+	UpstreamAddr   [16]byte
+	Path           [64]byte // URL path, only captured by the Go net/http probes
+	SizesKnown     uint8    // 1 if RequestBytes and BytesSent were captured
+}
+
+// httpEventSize is the size of struct http_event without its trailing padding
+const httpEventSize = 167
+
+// Decode fills e from a raw little-endian struct http_event without allocating
+func (e *HttpEvent) Decode(raw []byte) error {
+	if len(raw) < httpEventSize {
+		return errShortEvent
+	}
+
+	le := binary.LittleEndian
+	e.Timestamp = le.Uint64(raw[0:])
+	e.LatencyNs = le.Uint64(raw[8:])
+	e.TTFBNs = le.Uint64(raw[16:])
+	e.UpstreamNs = le.Uint64(raw[24:])
+	e.RequestBytes = le.Uint64(raw[32:])
+	e.BytesSent = le.Uint64(raw[40:])
+	e.CPUNs = le.Uint64(raw[48:])
+	e.RunQueueNs = le.Uint64(raw[56:])
+	e.BlockedNs = le.Uint64(raw[64:])
+	e.ProcessId = le.Uint32(raw[72:])
+	e.SampleRate = le.Uint32(raw[76:])
+	e.Status = le.Uint16(raw[80:])
+	e.UpstreamFamily = le.Uint16(raw[82:])
+	e.UpstreamPort = le.Uint16(raw[84:])
+	copy(e.UpstreamAddr[:], raw[86:102])
+	copy(e.Path[:], raw[102:166])
+	e.SizesKnown = raw[166]
+	return nil
+}
+
+// errShortEvent is returned when a ringbuf record is smaller than the event it should hold
+var errShortEvent = errors.New("ringbuf record shorter than event")
+
+// PathString returns the captured URL path without the trailing NUL bytes
+func (e *HttpEvent) PathString() string {
+	if n := bytes.IndexByte(e.Path[:], 0); n >= 0 {
+		return string(e.Path[:n])
+	}
+	return string(e.Path[:])
+}
+
+// maxCachedPaths bounds the number of distinct URL paths kept by a pathCache
+const maxCachedPaths = 4096
+
+// pathCache interns captured URL paths, so repeated paths do not allocate per event
+type pathCache map[[64]byte]string
+
+// lookup returns the path as a string, "" if none was captured
+func (pc pathCache) lookup(path *[64]byte) string {
+	if path[0] == 0 {
+		return ""
+	}
+	if s, ok := pc[*path]; ok {
+		return s
+	}
+
+	n := bytes.IndexByte(path[:], 0)
+	if n < 0 {
+		n = len(path)
+	}
+	s := string(path[:n])
+	if len(pc) < maxCachedPaths {
+		pc[*path] = s
+	}
+	return s
 }
 
 // Configuration constants
@@ -31,53 +114,309 @@ const (
 	AgentID            = "trazor-agent-1"
 )
 
+// nginxSymbols are the functions probed in every nginx binary
+var nginxSymbols = []string{"ngx_http_process_request", "ngx_http_free_request"}
+
 func main() {
 	// Parse command line flags
 	testMode := flag.Bool("test", false, "Run component tests and exit")
+	benchMode := flag.Bool("bench", false, "Run component benchmarks and exit")
+	binaryPath := flag.String("binary", "/usr/sbin/nginx", "nginx executable to always probe (empty to rely on discovery only)")
+	discover := flag.Bool("discover", true, "Discover nginx processes, including ones in containers, and probe their binaries")
+	discoverInterval := flag.Duration("discover-interval", 5*time.Second, "Interval between process discovery scans")
+	watchInterval := flag.Duration("watch-interval", 2*time.Second, "Interval between checks of -binary for upgrades")
+	statusAddr := flag.String("status-addr", "localhost:8086", "Address of the status API (empty to disable)")
+	mode := flag.String("mode", "nginx", "Probe profile: nginx, go or trace")
+	goBinary := flag.String("go-binary", "", "Go executable serving net/http in go mode")
+	var traceSpecs traceFlags
+	flag.Var(&traceSpecs, "trace", "Function to trace as binary:symbol in trace mode (repeatable)")
+	sampleRate := flag.Uint("sample-rate", 1, "Submit only 1 in N completed requests from the kernel (1 disables sampling)")
+	adaptiveSampling := flag.Bool("adaptive-sampling", false, "Adjust the sample rate to stay within -event-budget, starting at -sample-rate")
+	eventBudget := flag.Float64("event-budget", 5000, "Events per second submitted by the kernel with -adaptive-sampling")
+	maxSampleRate := flag.Uint("max-sample-rate", 1000, "Highest 1-in-N rate -adaptive-sampling may choose")
+	percentileList := flag.String("percentiles", "90,99.9,99.99", "Comma-separated latency percentiles reported in percentiles_us")
+	percentileMethodName := flag.String("percentile-method", "nearest-rank", "Percentile estimation method: nearest-rank, linear or type7")
+	rollupList := flag.String("rollups", "1m,5m,1h", "Comma-separated rollup resolutions merged from the 10s windows, empty to disable")
+	hoppingList := flag.String("hopping", "", "Comma-separated hopping windows as size[/hop], e.g. 1m/10s, emitted every hop from 10s sub-windows")
+	exemplars := flag.Int("exemplars", defaultExemplars, "Slowest requests reported per window as exemplars, 0 to disable")
+	slowLogPath := flag.String("slow-log", "", "Append requests slower than -slow-threshold to this JSONL file")
+	slowThreshold := flag.Duration("slow-threshold", 500*time.Millisecond, "Latency above which requests are written to the slow log")
+	slowLogMaxBytes := flag.Int64("slow-log-max-bytes", 64<<20, "Size at which the slow log is rotated")
+	slowLogFiles := flag.Int("slow-log-files", 5, "Number of rotated slow log files kept")
+	heartbeat := flag.Bool("heartbeat", false, "Emit windows without requests (total_requests 0) and attach agent health to every window")
+	histogramSpec := flag.String("histogram", "exponential:50,2,20", "Latency histogram buckets: none, prometheus, explicit:<bounds>, exponential:<start>,<factor>,<count> or log-linear:<lowest>,<highest>,<sub-buckets> (µs)")
+	stackThreshold := flag.Duration("stack-threshold", 0, "Sample the user stacks of nginx workers serving requests in flight longer than this, 0 to disable")
+	stackFrequency := flag.Uint64("stack-frequency", 49, "Stack samples per second and CPU with -stack-threshold")
+	schedBreakdown := flag.Bool("sched-breakdown", false, "Split nginx request latency into on-CPU, run-queue and blocked time (traces every context switch)")
+	hostSnapshot := flag.Bool("host-snapshot", true, "Attach host CPU, load, pressure stall and cgroup throttling figures to every window")
+	debugEvents := flag.Bool("debug-events", false, "Log every event, in the agent and to trace_pipe")
 	flag.Parse()
 
 	if *testMode {
 		runTests()
 		return
 	}
-	// Set up graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if *benchMode {
+		runBenchmarks()
+		return
+	}
+
+	if *sampleRate < 1 || *sampleRate > math.MaxUint32 {
+		log.Fatalf("invalid -sample-rate %d", *sampleRate)
+	}
+	if *exemplars < 0 {
+		log.Fatalf("invalid -exemplars %d", *exemplars)
+	}
+	if *adaptiveSampling && (*eventBudget <= 0 || *maxSampleRate < *sampleRate || *maxSampleRate > math.MaxUint32) {
+		log.Fatalf("invalid adaptive sampling settings: -event-budget %g, -max-sample-rate %d", *eventBudget, *maxSampleRate)
+	}
+
+	percentiles, err := ParsePercentiles(*percentileList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	percentileMethod, err := ParsePercentileMethod(*percentileMethodName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	histogramLayout, err := ParseHistogramLayout(*histogramSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rollups, err := ParseRollups(*rollupList, WindowDuration)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hoppingWindows, err := ParseHoppingWindows(*hoppingList, WindowDuration)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var traceTargets []TraceTarget
+	switch *mode {
+	case "nginx":
+	case "go":
+		if *goBinary == "" {
+			log.Fatal("go mode needs -go-binary")
+		}
+	case "trace":
+		if len(traceSpecs) == 0 {
+			log.Fatal("trace mode needs at least one -trace binary:symbol")
+		}
+		for _, spec := range traceSpecs {
+			target, err := ParseTraceTarget(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			traceTargets = append(traceTargets, target)
+		}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+	// Set up graceful shutdown; every goroutine watches ctx, so one signal
+	// stops them all
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// boilerplate code
 	if err := rlimit.RemoveMemlock(); err != nil {
 		log.Fatal("Removing Memlock: ", err)
 	}
 
+	spec, err := loadTrazor_agent()
+	if err != nil {
+		log.Fatal("Loading eBPF spec: ", err)
+	}
+
+	// rewrite the debug switch before loading so the verifier can drop the bpf_printk calls
+	var debugValue uint32
+	if *debugEvents {
+		debugValue = 1
+	}
+	if err := spec.Variables["debug_events"].Set(debugValue); err != nil {
+		log.Fatal("Setting debug_events: ", err)
+	}
+
+	// the scheduler state is only tracked per request when the tracepoints are attached
+	schedTracing := *schedBreakdown && *mode == "nginx"
+	var schedValue uint32
+	if schedTracing {
+		schedValue = 1
+	}
+	if err := spec.Variables["sched_breakdown"].Set(schedValue); err != nil {
+		log.Fatal("Setting sched_breakdown: ", err)
+	}
+
+	// the LRU scheduler maps are preallocated too
+	if !schedTracing {
+		spec.Maps["sched_times"].MaxEntries = 1
+		spec.Maps["sched_start"].MaxEntries = 1
+	}
+
+	// slow requests bypass sampling, so the slow log misses none of them
+	var slowThresholdValue uint64
+	if *slowLogPath != "" {
+		slowThresholdValue = uint64(*slowThreshold)
+	}
+	if err := spec.Variables["slow_threshold_ns"].Set(slowThresholdValue); err != nil {
+		log.Fatal("Setting slow_threshold_ns: ", err)
+	}
+
+	// the stack trace map preallocates every stack, so keep it minimal when unused
+	stackSampling := *mode == "nginx" && *stackThreshold > 0
+	if !stackSampling {
+		spec.Maps["stacks"].MaxEntries = 1
+		spec.Maps["slow_stacks"].MaxEntries = 1
+	}
+
 	var objs trazor_agentObjects
-	if err := loadTrazor_agentObjects(&objs, nil); err != nil {
+	if err := spec.LoadAndAssign(&objs, nil); err != nil {
 		log.Fatal("Loading eBPF objects: ", err)
 	}
 	defer objs.Close()
 
-	// attach the programs to their respective uprobes
-	executable, err := link.OpenExecutable("/usr/sbin/nginx")
-	if err != nil {
-		log.Fatalf("opening executable: %v", err)
+	sampler := NewRequestSampler(objs.SampleRate, objs.RequestCount, objs.DroppedEvents)
+	if err := sampler.SetRate(uint32(*sampleRate)); err != nil {
+		log.Fatal("Setting sample rate: ", err)
 	}
 
-	conn_start, err := executable.Uprobe("ngx_http_process_request", objs.GetConnStart, nil)
-	if err != nil {
-		log.Fatalf("opening uprobe 'ngx_http_process_request': %v", err)
+	// attach the programs to their respective uprobes, once per unique nginx binary
+	probeManager := NewProbeManager([]ProbeSpec{
+		{Symbol: "ngx_http_process_request", Program: objs.GetConnStart},
+		{Symbol: "ngx_http_free_request", Program: objs.GetLatencyOnEnd},
+		{Symbol: "ngx_http_send_header", Program: objs.GetHeaderSent},
+		{Symbol: "ngx_http_upstream_init_request", Program: objs.GetUpstreamStart, Optional: true},
+		{Symbol: "ngx_http_upstream_finalize_request", Program: objs.GetUpstreamEnd, Optional: true},
+	}, NewNginxOffsetsConfigurator(objs.NginxOffsets))
+	defer probeManager.Close()
+
+	if *mode == "nginx" && *binaryPath != "" {
+		if err := probeManager.AttachPath(*binaryPath); err != nil {
+			if !*discover {
+				log.Fatalf("attaching probes to %s: %v", *binaryPath, err)
+			}
+			log.Printf("Attaching probes to %s: %v (relying on discovery)", *binaryPath, err)
+		}
+	}
+
+	// sample the user stacks of workers while their request is slow
+	var stackSampler *StackSampler
+	if stackSampling {
+		if err := objs.StackThresholdNs.Set(uint64(*stackThreshold)); err != nil {
+			log.Fatal("Setting stack_threshold_ns: ", err)
+		}
+		stackSampler, err = NewStackSampler(objs.SampleSlowStack, objs.Stacks, objs.SlowStacks, *stackFrequency)
+		if err != nil {
+			log.Fatalf("starting stack sampler: %v", err)
+		}
+		defer stackSampler.Close()
+		log.Printf("Sampling user stacks of requests slower than %v at %d Hz", *stackThreshold, *stackFrequency)
+	}
+
+	if schedTracing {
+		schedTracer, err := NewSchedTracer(objs.HandleSchedSwitch, objs.HandleSchedWakeup)
+		if err != nil {
+			log.Fatalf("attaching scheduler tracepoints: %v", err)
+		}
+		defer schedTracer.Close()
+	}
+
+	// in go mode, probe net/http.serverHandler.ServeHTTP of the Go service
+	if *mode == "go" {
+		goProbe := NewGoHTTPProbe(*goBinary)
+		defer goProbe.Close()
+
+		if err := goProbe.Attach(objs.GoHttpServeStart, objs.GoHttpServeEnd, objs.GoOffsets); err != nil {
+			log.Fatalf("attaching Go probes: %v", err)
+		}
+	}
+
+	// in trace mode, attach a uprobe/uretprobe pair to every traced function
+	functionTracer := NewFunctionTracer(traceTargets)
+	defer functionTracer.Close()
+
+	if err := functionTracer.Attach(objs.TraceFuncEntry, objs.TraceFuncExit); err != nil {
+		log.Fatalf("attaching trace probes: %v", err)
 	}
-	defer conn_start.Close()
 
-	conn_end, err := executable.Uprobe("ngx_http_free_request", objs.GetLatencyOnEnd, nil)
+	// open the ringbuf carrying the events of the current mode
+	eventsMap := objs.Events
+	if *mode == "trace" {
+		eventsMap = objs.FuncEvents
+	}
+	ringBuf, err := ringbuf.NewReader(eventsMap)
 	if err != nil {
-		log.Fatalf("opening uprobe 'ngx_http_free_request': %v", err)
+		log.Fatal("Opening ringbuf reader: ", err)
+	}
+	defer ringBuf.Close()
+
+	var adaptiveSampler *AdaptiveSampler
+	if *adaptiveSampling && *mode != "trace" {
+		adaptiveSampler = NewAdaptiveSampler(sampler, ringBuf, *eventBudget, uint32(*sampleRate), uint32(*maxSampleRate))
+	}
+
+	var slowLog *SlowLog
+	if *slowLogPath != "" {
+		slowLog, err = NewSlowLog(*slowLogPath, *slowThreshold, *slowLogMaxBytes, *slowLogFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer slowLog.Close()
+		log.Printf("Logging requests slower than %v to %s", *slowThreshold, *slowLogPath)
 	}
-	defer conn_end.Close()
 
 	// Initialize components
-	metricsChannel := make(chan *WindowMetrics, 10) // Buffer for metrics
+	metricsChannel := make(chan *WindowMetrics, 32) // Buffer for metrics, rollups end together with a window
 	windowAggregator := NewWindowAggregator(WindowDuration, metricsChannel)
+	aggregators := []*WindowAggregator{windowAggregator}
+
+	// each traced function is its own labeled series
+	traceAggregators := make([]*WindowAggregator, len(functionTracer.Targets()))
+	for i, target := range functionTracer.Targets() {
+		traceAggregators[i] = NewWindowAggregator(WindowDuration, metricsChannel)
+		traceAggregators[i].SetSeries(target.Label())
+	}
+	if *mode == "trace" {
+		aggregators = traceAggregators
+	}
+	for _, aggregator := range aggregators {
+		aggregator.SetPercentiles(percentiles, percentileMethod)
+		aggregator.SetHistogramLayout(histogramLayout)
+		aggregator.SetRollups(rollups)
+		aggregator.SetHoppingWindows(hoppingWindows)
+		aggregator.SetExemplars(*exemplars)
+	}
+
+	if *heartbeat {
+		health := NewHealthMonitor(ringBuf, func() int {
+			switch *mode {
+			case "trace":
+				return len(functionTracer.Targets())
+			case "go":
+				return 1
+			default:
+				return probeManager.AttachedCount()
+			}
+		})
+		for _, aggregator := range aggregators {
+			aggregator.SetHeartbeat(health)
+		}
+	}
+
+	if *hostSnapshot {
+		host := NewHostMonitor()
+		for _, aggregator := range aggregators {
+			aggregator.SetHostMonitor(host)
+		}
+	}
 	wsClient := NewWebSocketClient(WebSocketServerURL, AgentID)
 
+	if *statusAddr != "" {
+		statusServer := NewStatusServer(*statusAddr, AgentID, probeManager, wsClient)
+		statusServer.Start()
+		defer statusServer.Shutdown()
+	}
+
 	// Connect to WebSocket server (non-blocking)
 	go func() {
 		if err := wsClient.Connect(); err != nil {
@@ -98,13 +437,13 @@ func main() {
 			case metrics := <-metricsChannel:
 				if wsClient.IsConnected() { // check connection
 					wsClient.SendMetrics(metrics)
-					log.Printf("Sent metrics: %d requests, avg=%.2fμs, P50=%dμs, P95=%dμs, P99=%dμs",
-						metrics.TotalRequests, metrics.AvgLatency,
+					log.Printf("Sent metrics%s: %d requests, avg=%.2fμs, P50=%dμs, P95=%dμs, P99=%dμs",
+						seriesSuffix(metrics.Series), metrics.TotalRequests, metrics.AvgLatency,
 						metrics.P50Latency, metrics.P95Latency, metrics.P99Latency)
 				} else {
 					log.Printf("WebSocket not connected, metrics dropped: %d requests", metrics.TotalRequests)
 				}
-			case <-sigChan:
+			case <-ctx.Done():
 				return
 			}
 		}
@@ -115,59 +454,239 @@ func main() {
 		for {
 			select {
 			case <-windowTicker.C:
-				windowAggregator.RotateWindow() // each 10 seconds, rotate the metrics window
-			case <-sigChan:
+				// the kernel counts every completed request, sampled or not
+				if *mode != "trace" {
+					if completed, dropped, err := sampler.CountsSince(); err != nil {
+						log.Printf("Reading kernel request counts: %v", err)
+					} else {
+						windowAggregator.SetKernelCounts(completed, dropped)
+						if adaptiveSampler != nil {
+							adaptiveSampler.Adjust(completed, dropped, WindowDuration)
+						}
+					}
+				}
+				if stackSampler != nil {
+					if stacks, err := stackSampler.Collect(); err != nil {
+						log.Printf("Collecting slow stacks: %v", err)
+					} else {
+						windowAggregator.SetSlowStacks(stacks)
+					}
+				}
+				for _, aggregator := range aggregators {
+					aggregator.RotateWindow() // each 10 seconds, rotate the metrics window
+				}
+			case <-ctx.Done():
 				return
 			}
 		}
 	})
 
-	// Start ringbuf reader
-	ringBuf, err := ringbuf.NewReader(objs.Events)
-	if err != nil {
-		log.Fatal("Opening ringbuf reader: ", err)
+	// Start ringbuf pressure goroutine, backing off before events are dropped
+	if adaptiveSampler != nil {
+		pressureTicker := time.NewTicker(time.Second)
+		defer pressureTicker.Stop()
+
+		wg.Go(func() {
+			for {
+				select {
+				case <-pressureTicker.C:
+					adaptiveSampler.CheckPressure()
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
 	}
 
-	wg.Go(func() {
-		defer ringBuf.Close()
+	// Start process discovery goroutine
+	if *mode == "nginx" && *discover {
+		discovery := NewProcessDiscovery(nginxSymbols)
+		discoveryTicker := time.NewTicker(*discoverInterval)
+		defer discoveryTicker.Stop()
 
-		for {
-			select {
-			case <-sigChan:
-				return
-			default:
-			}
+		wg.Go(func() {
+			for {
+				discovered, err := discovery.Scan()
+				if err != nil {
+					log.Printf("Scanning processes: %v", err)
+				} else {
+					probeManager.Sync(discovered)
+				}
 
-			record, err := ringBuf.Read()
-			if err != nil {
-				log.Printf("Reading ringbuf: %v", err)
-				continue
+				select {
+				case <-discoveryTicker.C:
+				case <-ctx.Done():
+					return
+				}
 			}
+		})
+	}
 
-			// parse the binary record to type-safe struct
-			var event HttpEvent
-			if err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &event); err != nil {
-				fmt.Printf("parsing event: %v", err)
-				continue
-			}
+	// Start binary watcher goroutine, re-attaching probes after nginx upgrades
+	if *mode == "nginx" && *binaryPath != "" {
+		watchTicker := time.NewTicker(*watchInterval)
+		defer watchTicker.Stop()
 
-			// Add sample to current window
-			windowAggregator.AddSample(event.ProcessId, event.LatencyNs, int64(event.Timestamp))
+		wg.Go(func() {
+			for {
+				select {
+				case <-watchTicker.C:
+					probeManager.CheckPinned()
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
 
-			// Optional: Keep console output for debugging
-			fmt.Printf("Event: PID=%d, Latency=%dus\n", event.ProcessId, event.LatencyNs/1000)
-		}
-	})
+	// Start ringbuf reader
+	if *mode == "trace" {
+		wg.Go(func() {
+			readFuncEvents(ctx, ringBuf, traceAggregators, slowLog)
+		})
+	} else {
+		wg.Go(func() {
+			readHttpEvents(ctx, ringBuf, windowAggregator, slowLog, *debugEvents)
+		})
+	}
 
 	// Wait for shutdown signal
-	<-sigChan
+	<-ctx.Done()
 	log.Printf("Shutting down gracefully...")
 
 	// Close WebSocket connection
 	wsClient.Disconnect()
 
+	// wake the reader if it is waiting for an event; the ringbuf is closed only
+	// after the goroutines that read its fill level have stopped
+	ringBuf.SetDeadline(time.Now())
+
 	// Wait for goroutines to finish
 	wg.Wait()
 
 	log.Printf("Shutdown complete")
 }
+
+// readHttpEvents feeds nginx request events from the ringbuf into the aggregator
+// and the slow log, which may be nil
+func readHttpEvents(ctx context.Context, ringBuf *ringbuf.Reader, windowAggregator *WindowAggregator, slowLog *SlowLog, debugEvents bool) {
+	var record ringbuf.Record
+	var event HttpEvent
+	paths := make(pathCache)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// the record and event are reused, so the loop does not allocate per event
+		if err := ringBuf.ReadInto(&record); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue // woken for shutdown
+			}
+			log.Printf("Reading ringbuf: %v", err)
+			continue
+		}
+
+		// parse the binary record to type-safe struct
+		if err := event.Decode(record.RawSample); err != nil {
+			fmt.Printf("parsing event: %v", err)
+			continue
+		}
+
+		sample := LatencySample{
+			ProcessID:    event.ProcessId,
+			LatencyNs:    event.LatencyNs,
+			TTFBNs:       event.TTFBNs,
+			Timestamp:    ktimeToWall(event.Timestamp),
+			UpstreamNs:   event.UpstreamNs,
+			RequestBytes: event.RequestBytes,
+			BytesSent:    event.BytesSent,
+			SizesKnown:   event.SizesKnown != 0,
+			CPUNs:        event.CPUNs,
+			RunQueueNs:   event.RunQueueNs,
+			BlockedNs:    event.BlockedNs,
+			Status:       event.Status,
+			SampleRate:   event.SampleRate,
+			Path:         paths.lookup(&event.Path),
+			Upstream: UpstreamAddr{
+				Family: event.UpstreamFamily,
+				Port:   event.UpstreamPort,
+				IP:     event.UpstreamAddr,
+			},
+		}
+
+		// Add sample to current window
+		windowAggregator.AddLatencySample(sample)
+
+		if slowLog != nil {
+			if err := slowLog.Record(&sample, ""); err != nil {
+				log.Printf("Writing slow log: %v", err)
+			}
+		}
+
+		if !debugEvents {
+			continue
+		}
+		if path := event.PathString(); path != "" {
+			fmt.Printf("Event: PID=%d, Path=%s, Status=%d, Latency=%dus\n", event.ProcessId, path, event.Status, event.LatencyNs/1000)
+		} else {
+			fmt.Printf("Event: PID=%d, Status=%d, Latency=%dus\n", event.ProcessId, event.Status, event.LatencyNs/1000)
+		}
+	}
+}
+
+// readFuncEvents feeds traced function durations into the aggregator of their
+// series and the slow log, which may be nil
+func readFuncEvents(ctx context.Context, ringBuf *ringbuf.Reader, aggregators []*WindowAggregator, slowLog *SlowLog) {
+	var record ringbuf.Record
+	var event FuncEvent
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if err := ringBuf.ReadInto(&record); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue // woken for shutdown
+			}
+			log.Printf("Reading ringbuf: %v", err)
+			continue
+		}
+
+		if err := event.Decode(record.RawSample); err != nil {
+			fmt.Printf("parsing event: %v", err)
+			continue
+		}
+
+		if event.FuncID >= uint64(len(aggregators)) {
+			continue
+		}
+		aggregator := aggregators[event.FuncID]
+		sample := LatencySample{
+			ProcessID: event.ProcessId,
+			LatencyNs: event.LatencyNs,
+			Timestamp: ktimeToWall(event.Timestamp),
+		}
+		aggregator.AddLatencySample(sample)
+
+		if slowLog != nil {
+			if err := slowLog.Record(&sample, aggregator.Series()); err != nil {
+				log.Printf("Writing slow log: %v", err)
+			}
+		}
+	}
+}
+
+// seriesSuffix formats a series label for log lines
+func seriesSuffix(series string) string {
+	if series == "" {
+		return ""
+	}
+	return " [" + series + "]"
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/netip"
 	"time"
 )
 
@@ -16,21 +17,293 @@ type WindowMetrics struct {
 	P95Latency       uint64            `json:"p95_latency_us"`
 	P99Latency       uint64            `json:"p99_latency_us"`
 	ProcessBreakdown map[uint32]uint64 `json:"process_breakdown"`
+	Series           string            `json:"series,omitempty"` // traced function, empty for nginx requests
+	Resolution       string            `json:"resolution"`       // window length, e.g. "10s" or a rollup like "1h"
+	Hop              string            `json:"hop,omitempty"`    // emission interval of hopping windows
 	AgentID          string            `json:"agent_id"`
 	Timestamp        time.Time         `json:"timestamp"`
+
+	// Kernel-side sampling: counts, percentiles and per-bucket/per-upstream
+	// breakdowns weight each sampled request by its rate, so they estimate all
+	// requests (UpstreamMetrics.Requests is a weighted count too)
+	SampleRate      float64 `json:"sample_rate"`      // effective 1-in-N rate of the window
+	SampledRequests uint64  `json:"sampled_requests"` // requests that reached the agent
+	ExactRequests   uint64  `json:"exact_requests"`   // completed requests counted in the kernel, 0 if unknown
+	DroppedEvents   uint64  `json:"dropped_events"`   // sampled events lost to a full ringbuf
+
+	// Configured latency percentiles keyed by label, e.g. "p99.9"
+	Percentiles      map[string]uint64 `json:"percentiles_us"`
+	PercentileMethod string            `json:"percentile_method"`
+
+	// Request counts per latency bucket, scaled by the sampling rate
+	LatencyHistogram *LatencyHistogram `json:"latency_histogram,omitempty"`
+
+	// Time to first byte: request start until the response header was sent
+	TTFBP50Latency uint64 `json:"ttfb_p50_latency_us"`
+	TTFBP95Latency uint64 `json:"ttfb_p95_latency_us"`
+	TTFBP99Latency uint64 `json:"ttfb_p99_latency_us"`
+
+	// Request and response sizes
+	RequestBytes          uint64               `json:"request_bytes"`
+	ResponseBytes         uint64               `json:"response_bytes"`
+	RequestThroughput     float64              `json:"request_bytes_per_sec"`
+	ResponseThroughput    float64              `json:"response_bytes_per_sec"`
+	RequestSizeP50        uint64               `json:"request_size_p50_bytes"`
+	RequestSizeP95        uint64               `json:"request_size_p95_bytes"`
+	RequestSizeP99        uint64               `json:"request_size_p99_bytes"`
+	ResponseSizeP50       uint64               `json:"response_size_p50_bytes"`
+	ResponseSizeP95       uint64               `json:"response_size_p95_bytes"`
+	ResponseSizeP99       uint64               `json:"response_size_p99_bytes"`
+	LatencyByResponseSize []*SizeBucketMetrics `json:"latency_by_response_size,omitempty"`
+
+	// HTTP status: requests without a known status are left out of these fields.
+	// Failed requests are the ones answered with a 5xx status.
+	StatusClasses     map[string]uint64 `json:"status_classes"` // "1xx" to "5xx"
+	StatusCodes       map[uint16]uint64 `json:"status_codes"`
+	ErrorRequests     uint64            `json:"error_requests"`
+	ErrorRatio        float64           `json:"error_ratio"`
+	SuccessP50Latency uint64            `json:"success_p50_latency_us"`
+	SuccessP95Latency uint64            `json:"success_p95_latency_us"`
+	SuccessP99Latency uint64            `json:"success_p99_latency_us"`
+	ErrorP50Latency   uint64            `json:"error_p50_latency_us"`
+	ErrorP95Latency   uint64            `json:"error_p95_latency_us"`
+	ErrorP99Latency   uint64            `json:"error_p99_latency_us"`
+
+	// Reverse proxy split: time spent in upstreams versus inside nginx
+	NginxP50Latency    uint64                      `json:"nginx_p50_latency_us"`
+	NginxP95Latency    uint64                      `json:"nginx_p95_latency_us"`
+	NginxP99Latency    uint64                      `json:"nginx_p99_latency_us"`
+	UpstreamRequests   uint64                      `json:"upstream_requests"`
+	UpstreamP50Latency uint64                      `json:"upstream_p50_latency_us"`
+	UpstreamP95Latency uint64                      `json:"upstream_p95_latency_us"`
+	UpstreamP99Latency uint64                      `json:"upstream_p99_latency_us"`
+	UpstreamBreakdown  map[string]*UpstreamMetrics `json:"upstream_breakdown"`
+
+	// Scheduler split of the requests at or above P99, only with -sched-breakdown
+	P99Breakdown *LatencyBreakdown `json:"p99_breakdown,omitempty"`
+
+	// Slowest requests of the window, slowest first
+	Exemplars []Exemplar `json:"exemplars,omitempty"`
+
+	// User stacks of workers sampled while their request was slower than
+	// -stack-threshold, folded for flamegraph.pl, most sampled first
+	SlowStacks []FoldedStack `json:"slow_stacks,omitempty"`
+
+	// Host CPU, load, pressure stalls and cgroup throttling during the window
+	Host *HostSnapshot `json:"host,omitempty"`
+
+	// Agent state at the end of the window, only with heartbeats enabled
+	Health *AgentHealth `json:"agent_health,omitempty"`
+
+	sketches *windowSketches // distributions merged into rollups, nil without rollups
+}
+
+// LatencyBreakdown splits the latency of a set of requests by the scheduler state
+// of the worker thread serving them, averaged over the requests. The three
+// components add up to about the average latency.
+type LatencyBreakdown struct {
+	Requests   uint64 `json:"requests"`     // requests in the set, weighted by sample rate
+	LatencyUs  uint64 `json:"latency_us"`   // average latency
+	CPUUs      uint64 `json:"cpu_us"`       // on-CPU, including work on other requests of the worker
+	RunQueueUs uint64 `json:"run_queue_us"` // runnable, waiting for a CPU
+	BlockedUs  uint64 `json:"blocked_us"`   // sleeping, e.g. in epoll_wait or on disk I/O
+}
+
+// Exemplar is one concrete request of a window, with every attribute the probes captured
+type Exemplar struct {
+	Time          time.Time `json:"time"`
+	ProcessID     uint32    `json:"pid"`
+	LatencyUs     uint64    `json:"latency_us"`
+	TTFBUs        uint64    `json:"ttfb_us,omitempty"`
+	UpstreamUs    uint64    `json:"upstream_us,omitempty"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Status        uint16    `json:"status,omitempty"`
+	RequestBytes  uint64    `json:"request_bytes"`
+	ResponseBytes uint64    `json:"response_bytes"`
+	Path          string    `json:"path,omitempty"`
+	SampleRate    uint32    `json:"sample_rate,omitempty"`
+	CPUUs         uint64    `json:"cpu_us,omitempty"`
+	RunQueueUs    uint64    `json:"run_queue_us,omitempty"`
+	BlockedUs     uint64    `json:"blocked_us,omitempty"`
+}
+
+// newExemplars converts the slowest samples of a window into exemplars
+func newExemplars(samples []LatencySample) []Exemplar {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	exemplars := make([]Exemplar, len(samples))
+	for i := range samples {
+		exemplars[i] = newExemplar(&samples[i])
+	}
+	return exemplars
+}
+
+// newExemplar converts a sample into an exemplar
+func newExemplar(sample *LatencySample) Exemplar {
+	exemplar := Exemplar{
+		Time:          time.Unix(0, sample.Timestamp).UTC(),
+		ProcessID:     sample.ProcessID,
+		LatencyUs:     sample.LatencyNs / 1000,
+		TTFBUs:        sample.TTFBNs / 1000,
+		UpstreamUs:    sample.UpstreamNs / 1000,
+		Status:        sample.Status,
+		RequestBytes:  sample.RequestBytes,
+		ResponseBytes: sample.BytesSent,
+		Path:          sample.Path,
+		SampleRate:    sample.SampleRate,
+		CPUUs:         sample.CPUNs / 1000,
+		RunQueueUs:    sample.RunQueueNs / 1000,
+		BlockedUs:     sample.BlockedNs / 1000,
+	}
+	if sample.Upstream.Family != 0 {
+		exemplar.Upstream = sample.Upstream.String()
+	}
+	return exemplar
+}
+
+// newLatencyBreakdown averages the scheduler times of the samples at or above
+// threshold nanoseconds that carry them, nil if there are none
+func newLatencyBreakdown(samples map[uint32][]LatencySample, threshold uint64) *LatencyBreakdown {
+	var requests, latency, cpu, runQueue, blocked uint64
+	for _, processSamples := range samples {
+		for i := range processSamples {
+			sample := &processSamples[i]
+			if sample.LatencyNs < threshold || sample.CPUNs == 0 {
+				continue
+			}
+			weight := sample.weight()
+			requests += weight
+			latency += sample.LatencyNs * weight
+			cpu += sample.CPUNs * weight
+			runQueue += sample.RunQueueNs * weight
+			blocked += sample.BlockedNs * weight
+		}
+	}
+	if requests == 0 {
+		return nil
+	}
+
+	return &LatencyBreakdown{
+		Requests:   requests,
+		LatencyUs:  latency / requests / 1000,
+		CPUUs:      cpu / requests / 1000,
+		RunQueueUs: runQueue / requests / 1000,
+		BlockedUs:  blocked / requests / 1000,
+	}
+}
+
+// SizeBucketMetrics represents the latency of requests whose response size falls into a bucket
+type SizeBucketMetrics struct {
+	Bucket     string  `json:"bucket"`
+	MaxBytes   uint64  `json:"max_bytes"` // inclusive upper bound, 0 for the last bucket
+	Requests   uint64  `json:"requests"`
+	AvgLatency float64 `json:"avg_latency_us"`
+	P50Latency uint64  `json:"p50_latency_us"`
+	P95Latency uint64  `json:"p95_latency_us"`
+	P99Latency uint64  `json:"p99_latency_us"`
+}
+
+// responseSizeBuckets are the upper bounds of the latency-by-size matrix rows
+var responseSizeBuckets = []struct {
+	label    string
+	maxBytes uint64
+}{
+	{"<=1KiB", 1 << 10},
+	{"<=10KiB", 10 << 10},
+	{"<=100KiB", 100 << 10},
+	{"<=1MiB", 1 << 20},
+	{"<=10MiB", 10 << 20},
+	{">10MiB", 0},
+}
+
+// responseSizeBucket returns the index of the bucket holding size
+func responseSizeBucket(size uint64) int {
+	for i, bucket := range responseSizeBuckets {
+		if bucket.maxBytes == 0 || size <= bucket.maxBytes {
+			return i
+		}
+	}
+	return len(responseSizeBuckets) - 1
+}
+
+// statusClass returns the class of an HTTP status, e.g. "4xx", or "" if it is unknown
+func statusClass(status uint16) string {
+	if status < 100 || status > 599 {
+		return ""
+	}
+	return string(rune('0'+status/100)) + "xx"
+}
+
+// UpstreamMetrics represents the upstream latency of a single upstream address
+type UpstreamMetrics struct {
+	Requests   uint64  `json:"requests"`
+	AvgLatency float64 `json:"avg_latency_us"`
+	P50Latency uint64  `json:"p50_latency_us"`
+	P95Latency uint64  `json:"p95_latency_us"`
+	P99Latency uint64  `json:"p99_latency_us"`
 }
 
 // NewWindowMetrics creates a new WindowMetrics instance
 func NewWindowMetrics() *WindowMetrics {
 	return &WindowMetrics{
-		ProcessBreakdown: make(map[uint32]uint64),
-		Timestamp:        time.Now().UTC(),
+		ProcessBreakdown:  make(map[uint32]uint64),
+		UpstreamBreakdown: make(map[string]*UpstreamMetrics),
+		StatusClasses:     make(map[string]uint64),
+		StatusCodes:       make(map[uint16]uint64),
+		Percentiles:       make(map[string]uint64),
+		Timestamp:         time.Now().UTC(),
 	}
 }
 
 // LatencySample represents a single latency measurement
 type LatencySample struct {
-	ProcessID uint32
-	LatencyNs uint64
-	Timestamp int64
+	ProcessID    uint32
+	LatencyNs    uint64
+	Timestamp    int64        // wall-clock completion time in Unix nanoseconds
+	TTFBNs       uint64       // time until the response header was sent, 0 if unknown
+	UpstreamNs   uint64       // time spent in proxy_pass upstreams, 0 if not proxied
+	Upstream     UpstreamAddr // upstream peer address, zero if unknown
+	RequestBytes uint64       // request body size from Content-Length, 0 if unknown
+	BytesSent    uint64       // response bytes written to the connection
+	SizesKnown   bool         // RequestBytes and BytesSent were captured
+	CPUNs        uint64       // time the serving thread spent on-CPU, 0 if unknown
+	RunQueueNs   uint64       // time it was runnable but waiting for a CPU
+	BlockedNs    uint64       // time it was sleeping, e.g. in epoll_wait or on disk I/O
+	Status       uint16       // final HTTP status, 0 if unknown
+	SampleRate   uint32       // 1-in-N rate the sample was taken at, 0 if not sampled
+	Path         string       // URL path, empty if not captured
 }
+
+// weight returns the number of requests this sample stands for
+func (s *LatencySample) weight() uint64 {
+	return uint64(max(s.SampleRate, 1))
+}
+
+// UpstreamAddr is an upstream peer address as captured from struct sockaddr
+type UpstreamAddr struct {
+	Family uint16 // AF_INET or AF_INET6, 0 if unknown
+	Port   uint16
+	IP     [16]byte
+}
+
+// String formats the address as ip:port, or "unknown"
+func (a UpstreamAddr) String() string {
+	var addr netip.Addr
+	switch a.Family {
+	case afInet:
+		addr = netip.AddrFrom4([4]byte(a.IP[:4]))
+	case afInet6:
+		addr = netip.AddrFrom16(a.IP)
+	default:
+		return "unknown"
+	}
+	return netip.AddrPortFrom(addr, a.Port).String()
+}
+
+// Address families as stored in struct sockaddr
+const (
+	afInet  = 2
+	afInet6 = 10
+)
@@ -2,61 +2,788 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 
+#define PATH_LEN 64
+
+// Set by the agent at load time (-debug-events). Being read-only, the verifier
+// sees its value and removes the bpf_printk calls of default builds.
+volatile const __u32 debug_events = 0;
+
+// 1-in-N sampling of completed requests, changed by the agent at runtime
+volatile __u32 sample_rate = 1;
+
+// Set by the agent at load time (-slow-threshold with -slow-log): requests at
+// least this slow bypass sampling, so the slow log sees every one of them
+volatile const __u64 slow_threshold_ns = 0;
+
+// Age after which an in-flight request has the user stacks of its worker
+// sampled (-stack-threshold), 0 disables stack sampling
+volatile __u64 stack_threshold_ns = 0;
+
+#define MAX_STACK_DEPTH 127
+
+// Set by the agent at load time (-sched-breakdown): track the scheduler state
+// of workers serving a request from the sched_switch/sched_wakeup tracepoints
+volatile const __u32 sched_breakdown = 0;
+
+// Scheduler states of the thread serving a request
+#define SCHED_RUNNING 0
+#define SCHED_QUEUED 1  // runnable, waiting for a CPU
+#define SCHED_BLOCKED 2 // sleeping until woken up
+
+// prev_state bits of a task that went to sleep; a preempted task reports none
+// of them (TASK_RUNNING, or TASK_REPORT_MAX since 4.14)
+#define TASK_REPORT 0x7f
+
 struct http_event {
     __u64 timestamp;
     __u64 latency_ns;
+    __u64 ttfb_ns;     // time until the response header was sent, 0 if unknown
+    __u64 upstream_ns; // time spent in proxy_pass upstreams, 0 if not proxied
+    __u64 request_bytes; // request body size from Content-Length, 0 if unknown
+    __u64 bytes_sent;    // response bytes written to the connection
+    __u64 cpu_ns;        // time the serving thread spent on-CPU, 0 if unknown
+    __u64 runq_ns;       // time it was runnable but waiting for a CPU
+    __u64 blocked_ns;    // time it was sleeping, e.g. in epoll_wait or on disk I/O
+    __u32 pid;
+    __u32 sample_rate;   // 1-in-N rate the event was sampled at
+    __u16 status;        // final HTTP status, 0 if unknown
+    __u16 upstream_family;
+    __u16 upstream_port;
+    __u8 upstream_addr[16];
+    char path[PATH_LEN]; // URL path, only filled by the Go net/http probes
+    __u8 sizes_known;    // request_bytes and bytes_sent were captured
+};
+
+// Per-binary struct offsets, stored by Go under the attach cookie. An offset
+// of 0 means it could not be resolved and the field is not captured.
+struct nginx_offsets {
+    __u64 upstream_sockaddr;      // ngx_http_upstream_t.peer.sockaddr
+    __u64 request_connection;     // ngx_http_request_t.connection
+    __u64 request_content_length; // ngx_http_request_t.headers_in.content_length_n
+    __u64 connection_sent;        // ngx_connection_t.sent
+    __u64 request_status;         // ngx_http_request_t.headers_out.status
+};
+
+// A request of a worker. A worker multiplexes many requests, so per-request
+// state is keyed by its ngx_http_request_t pointer, which is only unique
+// within one process.
+struct req_key {
     __u32 pid;
+    __u32 pad;
+    __u64 r;
+};
+
+// Upstream (proxy_pass) time of a request
+struct upstream_info {
+    __u64 start;
+    __u64 duration;
+    __u16 family;
+    __u16 port;
+    __u8 addr[16];
+};
+
+// Scheduler time of the thread serving the requests of a worker, accumulated
+// since its first request
+struct sched_info {
+    __u64 last; // time of the last state change
+    __u64 cpu_ns;
+    __u64 runq_ns;
+    __u64 blocked_ns;
+    __u32 state;
+};
+
+// Scheduler times of a worker at a point in time
+struct sched_totals {
+    __u64 cpu_ns;
+    __u64 runq_ns;
+    __u64 blocked_ns;
+};
+
+// Requests in flight on a worker, which may interleave several of them. start
+// is when the worker went from idle to busy and is only reset once all of them
+// have ended, so it is never later than the start of the oldest one.
+struct in_flight {
+    __u64 start;
+    __u32 count;
 };
 
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __type(key, __u32);
-    __type(value, __u64);
+    __type(value, struct in_flight);
     __uint(max_entries, 256 * 1024);
-} latency SEC(".maps");
+} in_flight SEC(".maps");
+
+// Keyed by the worker's pid, which is also the thread id of the main thread
+// that serves its requests. Never deleted, so LRU to drop exited workers.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, __u32);
+    __type(value, struct sched_info);
+    __uint(max_entries, 256 * 1024);
+} sched_times SEC(".maps");
+
+// sched_times of the worker when a request started; the request is charged
+// what they grew by until it ends
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct req_key);
+    __type(value, struct sched_totals);
+    __uint(max_entries, 256 * 1024);
+} sched_start SEC(".maps");
 
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
+// connection->sent when a request started; keepalive connections accumulate
+// it across requests
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct req_key);
+    __type(value, __s64);
+    __uint(max_entries, 256 * 1024);
+} conn_sent SEC(".maps");
+
+// Start of each request, which the request latency is measured from; a worker
+// may interleave several of them, see in_flight
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct req_key);
+    __type(value, __u64);
+    __uint(max_entries, 256 * 1024);
+} request_start SEC(".maps");
+
+// Time the response header of a request was sent
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct req_key);
+    __type(value, __u64);
+    __uint(max_entries, 256 * 1024);
+} header_sent SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u64); // attach cookie
+    __type(value, struct nginx_offsets);
+    __uint(max_entries, 1024);
+} nginx_offsets SEC(".maps");
+
+// Subrequests, e.g. of auth_request, have their own r and are never passed to
+// ngx_http_free_request, so their entries are left to the LRU
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct req_key);
+    __type(value, struct upstream_info);
+    __uint(max_entries, 256 * 1024);
+} upstream SEC(".maps");
+
+// Completed requests, sampled or not, in a single per-CPU slot
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
+    __type(value, __u64);
+    __uint(max_entries, 1);
+} request_count SEC(".maps");
+
+// Sampled events that did not fit into the events ringbuf, per CPU
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, __u32);
+    __type(value, __u64);
+    __uint(max_entries, 1);
+} dropped_events SEC(".maps");
+
+// sample_request counts a completed request and returns whether it should be
+// submitted, storing the sampling rate it was decided with in rate
+static __always_inline int sample_request(__u32 *rate, __u64 latency) {
+    u32 zero = 0;
+    u64 *count = bpf_map_lookup_elem(&request_count, &zero);
+    if (count)
+        *count += 1;
+
+    // always submitted, so a slow request only stands for itself
+    if (slow_threshold_ns && latency >= slow_threshold_ns) {
+        *rate = 1;
+        return 1;
+    }
+
+    *rate = sample_rate > 1 ? sample_rate : 1;
+    return *rate == 1 || bpf_get_prandom_u32() % *rate == 0;
+}
+
+// count_drop counts an event lost to a full ringbuf
+static __always_inline void count_drop(void) {
+    u32 zero = 0;
+    u64 *dropped = bpf_map_lookup_elem(&dropped_events, &zero);
+    if (dropped)
+        *dropped += 1;
+}
+
+// req_key_init fills key for request r of the current worker
+static __always_inline void req_key_init(struct req_key *key, void *r) {
+    key->pid = bpf_get_current_pid_tgid() >> 32;
+    key->pad = 0;
+    key->r = (u64)r;
+}
+
+// sched_read reads the scheduler times of the current worker at ts. It is
+// running the calling probe, so it has been on-CPU since the last switch.
+static __always_inline int sched_read(u32 pid, u64 ts, struct sched_totals *totals) {
+    struct sched_info *sched = bpf_map_lookup_elem(&sched_times, &pid);
+    if (!sched)
+        return -1;
+    totals->cpu_ns = sched->cpu_ns + (ts - sched->last);
+    totals->runq_ns = sched->runq_ns;
+    totals->blocked_ns = sched->blocked_ns;
+    return 0;
+}
+
+// read_conn_sent reads r->connection->sent, returns 0 if the offsets are unknown
+static __always_inline s64 read_conn_sent(struct nginx_offsets *off, void *r) {
+    void *c = NULL;
+    s64 sent = 0;
+
+    if (!off->connection_sent || !off->request_connection)
+        return 0;
+    if (bpf_probe_read_user(&c, sizeof(c), r + off->request_connection) || !c)
+        return 0;
+    if (bpf_probe_read_user(&sent, sizeof(sent), c + off->connection_sent))
+        return 0;
+    return sent;
+}
+
+// ngx_http_process_request(ngx_http_request_t *r)
 SEC("uprobe/ngx_http_process_request")
 int get_conn_start(struct pt_regs *ctx) {
 
     u64 ts = bpf_ktime_get_ns();
     u32 pid = bpf_get_current_pid_tgid() >> 32; // left-shift for process id only
 
-    bpf_map_update_elem(&latency, &pid, &ts, BPF_NOEXIST); 
+    // r may be reused memory of a request whose entries were left behind; one
+    // whose start is still recorded was already counted as in flight
+    struct req_key key;
+    req_key_init(&key, (void *)ctx->di);
+    if (!bpf_map_lookup_elem(&request_start, &key)) {
+        struct in_flight *busy = bpf_map_lookup_elem(&in_flight, &pid);
+        if (busy) {
+            busy->count++;
+        } else {
+            struct in_flight first = {.start = ts, .count = 1};
+            bpf_map_update_elem(&in_flight, &pid, &first, BPF_ANY);
+        }
+    }
+    bpf_map_update_elem(&request_start, &key, &ts, BPF_ANY);
+    bpf_map_delete_elem(&upstream, &key);
+    bpf_map_delete_elem(&header_sent, &key);
+
+    // the worker is running this probe, so a worker seen for the first time
+    // starts on-CPU
+    if (sched_breakdown) {
+        struct sched_info sched = {.last = ts, .state = SCHED_RUNNING};
+        bpf_map_update_elem(&sched_times, &pid, &sched, BPF_NOEXIST);
 
-    bpf_printk("Accepted connection from pid %d at time %llu", pid, ts);
+        struct sched_totals totals;
+        if (!sched_read(pid, ts, &totals))
+            bpf_map_update_elem(&sched_start, &key, &totals, BPF_ANY);
+    }
+
+    u64 cookie = bpf_get_attach_cookie(ctx);
+    struct nginx_offsets *off = bpf_map_lookup_elem(&nginx_offsets, &cookie);
+    if (off) {
+        s64 sent = read_conn_sent(off, (void *)ctx->di);
+        bpf_map_update_elem(&conn_sent, &key, &sent, BPF_ANY);
+    }
+
+    if (debug_events)
+        bpf_printk("Accepted connection from pid %d at time %llu", pid, ts);
 
     return 0;
 }
 
+// ngx_http_free_request(ngx_http_request_t *r, ngx_int_t rc)
 SEC("uprobe/ngx_http_free_request")
 int get_latency_on_end(struct pt_regs *ctx) {
     struct http_event *req_info;
     u32 pid = bpf_get_current_pid_tgid() >> 32;
     u64 ts = bpf_ktime_get_ns();
+    u32 rate;
+
+    struct req_key key;
+    req_key_init(&key, (void *)ctx->di);
+
+    // get start time of this request
+    u64 *init = bpf_map_lookup_elem(&request_start, &key);
+    u64 latency = init ? ts - *init : 0;
+
+    if (!sample_request(&rate, latency))
+        goto cleanup;
+
+    // started before the probes were attached, or evicted: counted, but
+    // there is no latency to report
+    if (!init)
+        goto cleanup;
 
     // last value is always 0, for some reason...
     req_info = bpf_ringbuf_reserve(&events, sizeof(*req_info), 0);
-    if (!req_info) // no valid memory allocated, returned NULL
-        return 0;
+    if (!req_info) { // no valid memory allocated, returned NULL
+        count_drop();
+        goto cleanup;
+    }
 
     req_info->timestamp = ts;
+    req_info->sample_rate = rate;
+    __builtin_memset(req_info->path, 0, sizeof(req_info->path));
 
-    // get start time of this request 
-    u64 *init = bpf_map_lookup_elem(&latency, &pid);
-    if (init) {
-        u64 delta = ts - *init;
-        req_info->latency_ns = delta;
-        req_info->pid = pid;
-    } 
+    // attach the upstream time if the request was proxied
+    struct upstream_info *up = bpf_map_lookup_elem(&upstream, &key);
+    if (up) {
+        req_info->upstream_ns = up->duration;
+        req_info->upstream_family = up->family;
+        req_info->upstream_port = up->port;
+        __builtin_memcpy(req_info->upstream_addr, up->addr, sizeof(req_info->upstream_addr));
+    } else {
+        req_info->upstream_ns = 0;
+        req_info->upstream_family = 0;
+        req_info->upstream_port = 0;
+        __builtin_memset(req_info->upstream_addr, 0, sizeof(req_info->upstream_addr));
+    }
+
+    // request and response sizes, when the struct offsets are known
+    req_info->request_bytes = 0;
+    req_info->bytes_sent = 0;
+    req_info->sizes_known = 0;
+    req_info->status = 0;
+    u64 cookie = bpf_get_attach_cookie(ctx);
+    struct nginx_offsets *off = bpf_map_lookup_elem(&nginx_offsets, &cookie);
+    if (off) {
+        void *r = (void *)ctx->di;
+        s64 content_length = 0;
+        if (off->request_content_length &&
+            !bpf_probe_read_user(&content_length, sizeof(content_length), r + off->request_content_length) &&
+            content_length > 0)
+            req_info->request_bytes = content_length;
+
+        s64 *sent_start = bpf_map_lookup_elem(&conn_sent, &key);
+        s64 sent = read_conn_sent(off, r);
+        if (sent_start && sent > *sent_start)
+            req_info->bytes_sent = sent - *sent_start;
+
+        // without the offsets both sizes read as 0, which is not a real size
+        req_info->sizes_known = off->request_content_length && off->request_connection &&
+                                off->connection_sent && sent_start;
+
+        // headers_out.status is an ngx_uint_t
+        u64 status = 0;
+        if (off->request_status &&
+            !bpf_probe_read_user(&status, sizeof(status), r + off->request_status) &&
+            status < 1000)
+            req_info->status = status;
+    }
+
+    struct sched_totals *start = bpf_map_lookup_elem(&sched_start, &key);
+    struct sched_totals end;
+    if (start && !sched_read(pid, ts, &end)) {
+        req_info->cpu_ns = end.cpu_ns - start->cpu_ns;
+        req_info->runq_ns = end.runq_ns - start->runq_ns;
+        req_info->blocked_ns = end.blocked_ns - start->blocked_ns;
+    } else {
+        req_info->cpu_ns = 0;
+        req_info->runq_ns = 0;
+        req_info->blocked_ns = 0;
+    }
+
+    req_info->latency_ns = latency;
+    req_info->pid = pid;
+
+    u64 *header_ts = bpf_map_lookup_elem(&header_sent, &key);
+    req_info->ttfb_ns = 0;
+    if (header_ts && *header_ts >= *init)
+        req_info->ttfb_ns = *header_ts - *init;
 
     bpf_ringbuf_submit(req_info, 0);
 
-    bpf_map_delete_elem(&latency, &pid);
+cleanup:
+    // only requests whose start was seen were counted as in flight
+    if (init) {
+        struct in_flight *busy = bpf_map_lookup_elem(&in_flight, &pid);
+        if (busy && busy->count > 1)
+            busy->count--;
+        else if (busy)
+            bpf_map_delete_elem(&in_flight, &pid);
+    }
+    bpf_map_delete_elem(&request_start, &key);
+    bpf_map_delete_elem(&upstream, &key);
+    bpf_map_delete_elem(&header_sent, &key);
+    bpf_map_delete_elem(&conn_sent, &key);
+    bpf_map_delete_elem(&sched_start, &key);
+
+    return 0;
+}
+
+// ngx_http_send_header(ngx_http_request_t *r) runs once the response header is
+// ready; error pages may call it again, so only the first call is kept
+SEC("uprobe/ngx_http_send_header")
+int get_header_sent(struct pt_regs *ctx) {
+    u64 ts = bpf_ktime_get_ns();
+    struct req_key key;
+    req_key_init(&key, (void *)ctx->di);
+
+    bpf_map_update_elem(&header_sent, &key, &ts, BPF_NOEXIST);
+
+    return 0;
+}
+
+// ngx_http_upstream_init_request(ngx_http_request_t *r)
+SEC("uprobe/ngx_http_upstream_init_request")
+int get_upstream_start(struct pt_regs *ctx) {
+    struct req_key key;
+    req_key_init(&key, (void *)ctx->di);
+    struct upstream_info info = {};
+    info.start = bpf_ktime_get_ns();
+
+    bpf_map_update_elem(&upstream, &key, &info, BPF_ANY);
+
+    return 0;
+}
+
+// ngx_http_upstream_finalize_request(ngx_http_request_t *r, ngx_http_upstream_t *u, ngx_int_t rc)
+SEC("uprobe/ngx_http_upstream_finalize_request")
+int get_upstream_end(struct pt_regs *ctx) {
+    struct req_key key;
+    req_key_init(&key, (void *)ctx->di);
+    u64 ts = bpf_ktime_get_ns();
+
+    struct upstream_info *info = bpf_map_lookup_elem(&upstream, &key);
+    if (!info || !info->start)
+        return 0;
+
+    info->duration = ts - info->start;
+    info->start = 0;
+
+    u64 cookie = bpf_get_attach_cookie(ctx);
+    struct nginx_offsets *off = bpf_map_lookup_elem(&nginx_offsets, &cookie);
+    if (!off || !off->upstream_sockaddr)
+        return 0;
+
+    void *u = (void *)ctx->si;
+    void *sa = NULL;
+    if (bpf_probe_read_user(&sa, sizeof(sa), u + off->upstream_sockaddr) || !sa)
+        return 0;
+
+    // sockaddr_in and sockaddr_in6 both start with family and port
+    u16 family = 0;
+    bpf_probe_read_user(&family, sizeof(family), sa);
+    if (family == 2) { // AF_INET: sin_addr follows the port
+        bpf_probe_read_user(info->addr, 4, sa + 4);
+    } else if (family == 10) { // AF_INET6: sin6_addr follows sin6_flowinfo
+        bpf_probe_read_user(info->addr, 16, sa + 8);
+    } else {
+        return 0;
+    }
+
+    u16 port = 0;
+    bpf_probe_read_user(&port, sizeof(port), sa + 2);
+    info->family = family;
+    info->port = __builtin_bswap16(port);
+
+    return 0;
+}
+
+// The previous task leaves the CPU, preempted or going to sleep, and the next
+// one gets it. Only workers that have served a request have a sched_times entry.
+SEC("tracepoint/sched/sched_switch")
+int handle_sched_switch(struct trace_event_raw_sched_switch *ctx) {
+    u64 ts = bpf_ktime_get_ns();
+    u32 prev = ctx->prev_pid;
+    u32 next = ctx->next_pid;
+
+    struct sched_info *info = bpf_map_lookup_elem(&sched_times, &prev);
+    if (info && info->state == SCHED_RUNNING) {
+        info->cpu_ns += ts - info->last;
+        info->state = ctx->prev_state & TASK_REPORT ? SCHED_BLOCKED : SCHED_QUEUED;
+        info->last = ts;
+    }
+
+    info = bpf_map_lookup_elem(&sched_times, &next);
+    if (info) {
+        // without a wakeup, e.g. one missed under load, the whole sleep is blocked time
+        if (info->state == SCHED_QUEUED)
+            info->runq_ns += ts - info->last;
+        else if (info->state == SCHED_BLOCKED)
+            info->blocked_ns += ts - info->last;
+        info->state = SCHED_RUNNING;
+        info->last = ts;
+    }
+
+    return 0;
+}
+
+// A sleeping task is put on a run queue
+SEC("tracepoint/sched/sched_wakeup")
+int handle_sched_wakeup(struct trace_event_raw_sched_wakeup_template *ctx) {
+    u64 ts = bpf_ktime_get_ns();
+    u32 pid = ctx->pid;
+
+    struct sched_info *info = bpf_map_lookup_elem(&sched_times, &pid);
+    if (info && info->state == SCHED_BLOCKED) {
+        info->blocked_ns += ts - info->last;
+        info->state = SCHED_QUEUED;
+        info->last = ts;
+    }
+
+    return 0;
+}
+
+// User stacks of workers serving slow requests, counted per process and stack
+struct stack_key {
+    __u32 pid;
+    __s32 stack_id;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, MAX_STACK_DEPTH * sizeof(__u64));
+    __uint(max_entries, 16384);
+} stacks SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct stack_key);
+    __type(value, __u64);
+    __uint(max_entries, 16384);
+} slow_stacks SEC(".maps");
+
+// Runs on every CPU at the sampling frequency of a CPU clock perf event. If
+// the interrupted task is an nginx worker that has had requests in flight
+// without a break for longer than stack_threshold_ns, its user stack is
+// recorded.
+SEC("perf_event")
+int sample_slow_stack(struct bpf_perf_event_data *ctx) {
+    if (!stack_threshold_ns)
+        return 0;
+
+    u32 pid = bpf_get_current_pid_tgid() >> 32;
+    struct in_flight *busy = bpf_map_lookup_elem(&in_flight, &pid);
+    if (!busy || bpf_ktime_get_ns() - busy->start < stack_threshold_ns)
+        return 0;
+
+    struct stack_key key = {.pid = pid};
+    key.stack_id = bpf_get_stackid(ctx, &stacks, BPF_F_USER_STACK);
+    if (key.stack_id < 0)
+        return 0;
+
+    u64 *count = bpf_map_lookup_elem(&slow_stacks, &key);
+    if (count) {
+        __sync_fetch_and_add(count, 1);
+    } else {
+        u64 one = 1;
+        bpf_map_update_elem(&slow_stacks, &key, &one, BPF_NOEXIST);
+    }
+
+    return 0;
+}
+
+// Generic function-latency tracing: one uprobe/uretprobe pair per traced
+// symbol, identified by the attach cookie set from Go
+struct func_key {
+    __u64 pid_tgid;
+    __u64 func_id;
+};
+
+struct func_event {
+    __u64 timestamp;
+    __u64 latency_ns;
+    __u64 func_id;
+    __u32 pid;
+    __u32 tid;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct func_key);
+    __type(value, __u64);
+    __uint(max_entries, 64 * 1024);
+} func_start SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} func_events SEC(".maps");
+
+SEC("uprobe/trace_func_entry")
+int trace_func_entry(struct pt_regs *ctx) {
+    struct func_key key = {
+        .pid_tgid = bpf_get_current_pid_tgid(), // keyed by thread, not process
+        .func_id = bpf_get_attach_cookie(ctx),
+    };
+    u64 ts = bpf_ktime_get_ns();
+
+    bpf_map_update_elem(&func_start, &key, &ts, BPF_ANY);
+
+    return 0;
+}
+
+SEC("uretprobe/trace_func_exit")
+int trace_func_exit(struct pt_regs *ctx) {
+    struct func_event *func_info;
+    struct func_key key = {
+        .pid_tgid = bpf_get_current_pid_tgid(),
+        .func_id = bpf_get_attach_cookie(ctx),
+    };
+    u64 ts = bpf_ktime_get_ns();
+
+    u64 *init = bpf_map_lookup_elem(&func_start, &key);
+    if (!init) // entry happened before the probe was attached
+        return 0;
+
+    func_info = bpf_ringbuf_reserve(&func_events, sizeof(*func_info), 0);
+    if (func_info) {
+        func_info->timestamp = ts;
+        func_info->latency_ns = ts - *init;
+        func_info->func_id = key.func_id;
+        func_info->pid = key.pid_tgid >> 32;
+        func_info->tid = (u32)key.pid_tgid;
+        bpf_ringbuf_submit(func_info, 0);
+    }
+
+    bpf_map_delete_elem(&func_start, &key);
+
+    return 0;
+}
+
+// Go net/http server probes. Uretprobes corrupt Go stacks when they move, so
+// the end of ServeHTTP is probed at every RET instruction instead, and
+// requests are keyed by goroutine ID because goroutines migrate between threads.
+struct go_offsets {
+    __u64 goid;        // runtime.g.goid
+    __u64 request_url; // net/http.Request.URL
+    __u64 url_path;    // net/url.URL.Path
+};
+
+struct go_req_key {
+    __u32 pid;
+    __u32 pad;
+    __u64 goid;
+};
+
+struct go_req_info {
+    __u64 start;
+    char path[PATH_LEN];
+};
+
+struct go_string {
+    const char *ptr;
+    __s64 len;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u64); // attach cookie
+    __type(value, struct go_offsets);
+    __uint(max_entries, 64);
+} go_offsets SEC(".maps");
+
+// A handler that panics never reaches the end probe, so its entry is left to
+// the LRU rather than leaking
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct go_req_key);
+    __type(value, struct go_req_info);
+    __uint(max_entries, 64 * 1024);
+} go_requests SEC(".maps");
+
+// go_req_key_init reads the goroutine ID from the g pointer, which Go's
+// register ABI keeps in R14 (amd64 only)
+static __always_inline int go_req_key_init(struct pt_regs *ctx, struct go_offsets *off, struct go_req_key *key) {
+    key->pid = bpf_get_current_pid_tgid() >> 32;
+    key->pad = 0;
+    return bpf_probe_read_user(&key->goid, sizeof(key->goid), (void *)ctx->r14 + off->goid);
+}
+
+SEC("uprobe/go_http_serve_start")
+int go_http_serve_start(struct pt_regs *ctx) {
+    u64 cookie = bpf_get_attach_cookie(ctx);
+    struct go_offsets *off = bpf_map_lookup_elem(&go_offsets, &cookie);
+    if (!off)
+        return 0;
+
+    struct go_req_key key;
+    if (go_req_key_init(ctx, off, &key))
+        return 0;
+
+    struct go_req_info info = {};
+    info.start = bpf_ktime_get_ns();
+
+    // serverHandler.ServeHTTP(rw ResponseWriter, req *Request): receiver in
+    // AX, rw in BX/CX, req in DI
+    void *req = (void *)ctx->di;
+    void *url = NULL;
+    struct go_string path = {};
+    if (!bpf_probe_read_user(&url, sizeof(url), req + off->request_url) && url &&
+        !bpf_probe_read_user(&path, sizeof(path), url + off->url_path) && path.len > 0) {
+        u64 len = path.len;
+        if (len > PATH_LEN - 1)
+            len = PATH_LEN - 1;
+        bpf_probe_read_user(info.path, len & (PATH_LEN - 1), path.ptr);
+    }
+
+    bpf_map_update_elem(&go_requests, &key, &info, BPF_ANY);
+
+    return 0;
+}
+
+SEC("uprobe/go_http_serve_end")
+int go_http_serve_end(struct pt_regs *ctx) {
+    struct http_event *req_info;
+    u64 cookie = bpf_get_attach_cookie(ctx);
+    struct go_offsets *off = bpf_map_lookup_elem(&go_offsets, &cookie);
+    if (!off)
+        return 0;
+
+    struct go_req_key key;
+    if (go_req_key_init(ctx, off, &key))
+        return 0;
+
+    struct go_req_info *info = bpf_map_lookup_elem(&go_requests, &key);
+    if (!info)
+        return 0;
+
+    u64 ts = bpf_ktime_get_ns();
+    u64 latency = ts - info->start;
+    u32 rate;
+
+    if (!sample_request(&rate, latency))
+        goto cleanup;
+
+    req_info = bpf_ringbuf_reserve(&events, sizeof(*req_info), 0);
+    if (req_info) {
+        req_info->timestamp = ts;
+        req_info->sample_rate = rate;
+        req_info->latency_ns = latency;
+        req_info->ttfb_ns = 0;
+        req_info->upstream_ns = 0;
+        req_info->request_bytes = 0;
+        req_info->bytes_sent = 0;
+        req_info->sizes_known = 0;
+        req_info->cpu_ns = 0;
+        req_info->runq_ns = 0;
+        req_info->blocked_ns = 0;
+        req_info->status = 0;
+        req_info->pid = key.pid;
+        req_info->upstream_family = 0;
+        req_info->upstream_port = 0;
+        __builtin_memset(req_info->upstream_addr, 0, sizeof(req_info->upstream_addr));
+        __builtin_memcpy(req_info->path, info->path, sizeof(req_info->path));
+        bpf_ringbuf_submit(req_info, 0);
+    } else {
+        count_drop();
+    }
+
+cleanup:
+    bpf_map_delete_elem(&go_requests, &key);
 
     return 0;
 }
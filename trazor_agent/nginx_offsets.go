@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+)
+
+// nginxOffsets mirrors struct nginx_offsets in monitoring.c
+type nginxOffsets = trazor_agentNginxOffsets
+
+// BinaryConfigurator prepares per-binary state, such as struct offsets,
+// stored under the attach cookie of the binary's probes
+type BinaryConfigurator interface {
+	Configure(cookie uint64, path string) error
+	Release(cookie uint64)
+}
+
+// NginxOffsetsConfigurator resolves nginx struct offsets from DWARF and
+// stores them in the nginx_offsets map
+type NginxOffsetsConfigurator struct {
+	offsetsMap *ebpf.Map
+}
+
+// NewNginxOffsetsConfigurator creates a new NginxOffsetsConfigurator
+func NewNginxOffsetsConfigurator(offsetsMap *ebpf.Map) *NginxOffsetsConfigurator {
+	return &NginxOffsetsConfigurator{offsetsMap: offsetsMap}
+}
+
+// Configure stores the offsets of the binary at path. Binaries without debug
+// info get zero offsets, which disables the fields that need them.
+func (nc *NginxOffsetsConfigurator) Configure(cookie uint64, path string) error {
+	offsets, err := resolveNginxOffsets(path)
+	if err != nil {
+		log.Printf("Resolving nginx struct offsets for %s: %v (upstream addresses, byte sizes and status codes disabled)", path, err)
+	}
+
+	if err := nc.offsetsMap.Put(cookie, offsets); err != nil {
+		return fmt.Errorf("storing nginx offsets: %w", err)
+	}
+	return nil
+}
+
+// Release removes the offsets of a detached binary
+func (nc *NginxOffsetsConfigurator) Release(cookie uint64) {
+	nc.offsetsMap.Delete(cookie)
+}
+
+// resolveNginxOffsets reads the struct member offsets needed by the nginx probes from DWARF
+func resolveNginxOffsets(path string) (nginxOffsets, error) {
+	data, err := openDWARF(path)
+	if err != nil {
+		return nginxOffsets{}, err
+	}
+
+	upstreamSockaddr := dwarfMember{Type: "ngx_http_upstream_s", Member: "peer.sockaddr"}
+	requestConnection := dwarfMember{Type: "ngx_http_request_s", Member: "connection"}
+	requestContentLength := dwarfMember{Type: "ngx_http_request_s", Member: "headers_in.content_length_n"}
+	connectionSent := dwarfMember{Type: "ngx_connection_s", Member: "sent"}
+	requestStatus := dwarfMember{Type: "ngx_http_request_s", Member: "headers_out.status"}
+
+	found, err := dwarfMemberOffsets(data, []dwarfMember{
+		upstreamSockaddr, requestConnection, requestContentLength, connectionSent, requestStatus,
+	})
+	if err != nil {
+		return nginxOffsets{}, err
+	}
+
+	return nginxOffsets{
+		UpstreamSockaddr:     found[upstreamSockaddr],
+		RequestConnection:    found[requestConnection],
+		RequestContentLength: found[requestContentLength],
+		ConnectionSent:       found[connectionSent],
+		RequestStatus:        found[requestStatus],
+	}, nil
+}
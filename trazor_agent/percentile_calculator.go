@@ -1,11 +1,107 @@
 package main
 
 import (
-	"sort"
+	"cmp"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
 )
 
+// PercentileMethod selects how a percentile is estimated from a sample
+type PercentileMethod int
+
+const (
+	// NearestRank returns the smallest value with at least p% of the sample at or below it
+	NearestRank PercentileMethod = iota
+	// LinearInterpolation interpolates the empirical CDF (Hyndman-Fan type 4)
+	LinearInterpolation
+	// HyndmanFanType7 interpolates between the order statistics at (n-1)p, as R and NumPy do by default
+	HyndmanFanType7
+)
+
+// ParsePercentileMethod parses "nearest-rank", "linear" or "type7"
+func ParsePercentileMethod(name string) (PercentileMethod, error) {
+	switch name {
+	case "nearest-rank":
+		return NearestRank, nil
+	case "linear":
+		return LinearInterpolation, nil
+	case "type7":
+		return HyndmanFanType7, nil
+	}
+	return 0, fmt.Errorf("unknown percentile method %q, expected nearest-rank, linear or type7", name)
+}
+
+func (m PercentileMethod) String() string {
+	switch m {
+	case LinearInterpolation:
+		return "linear"
+	case HyndmanFanType7:
+		return "type7"
+	default:
+		return "nearest-rank"
+	}
+}
+
+// ParsePercentiles parses a comma-separated list of percentiles such as "50,99,99.9"
+func ParsePercentiles(list string) ([]float64, error) {
+	var percentiles []float64
+	for field := range strings.SplitSeq(list, ",") {
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile %q", field)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, nil
+}
+
+// PercentileLabel returns the key of a percentile in WindowMetrics.Percentiles, e.g. "p99.9"
+func PercentileLabel(percentile float64) string {
+	return "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+}
+
+// percentilePosition returns the bracketing order statistics lo and hi of the
+// percentile in n sorted values, and the weight of hi in the estimate
+func (m PercentileMethod) percentilePosition(n int, percentile float64) (lo, hi int, frac float64) {
+	p := percentile / 100.0
+
+	var h float64 // 0-based fractional position
+	switch m {
+	case LinearInterpolation:
+		h = float64(n)*p - 1
+	case HyndmanFanType7:
+		h = float64(n-1) * p
+	default:
+		// the tolerance keeps float error in p (99.9/100) from skipping a rank
+		h = math.Ceil(float64(n)*p-1e-9) - 1
+	}
+	h = min(max(h, 0), float64(n-1))
+
+	lo = int(h)
+	frac = h - float64(lo)
+	hi = min(lo+1, n-1)
+	if frac == 0 {
+		hi = lo
+	}
+	return lo, hi, frac
+}
+
+// estimate computes a percentile from its bracketing order statistics
+func estimate(low, high uint64, frac float64) uint64 {
+	if frac == 0 || low == high {
+		return low
+	}
+	return low + uint64(math.Round(frac*float64(high-low)))
+}
+
 // CalculatePercentile calculates the nth percentile of a slice of latency values
-// Uses a more efficient approach than full sorting for large datasets
+// using the nearest-rank method. Uses a more efficient approach than full
+// sorting for large datasets
 func CalculatePercentile(latencies []uint64, percentile float64) uint64 {
 	if len(latencies) == 0 {
 		return 0
@@ -22,80 +118,131 @@ func CalculatePercentile(latencies []uint64, percentile float64) uint64 {
 
 // calculatePercentileSorted sorts the data and returns the percentile value
 func calculatePercentileSorted(latencies []uint64, percentile float64) uint64 {
-	sorted := make([]uint64, len(latencies))
-	copy(sorted, latencies)
-	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
 
-	index := float64(len(sorted)-1) * (percentile / 100.0)
-	ceilIndex := int(index)
-	if ceilIndex >= len(sorted) {
-		ceilIndex = len(sorted) - 1
-	}
-	return sorted[ceilIndex]
+	index, _, _ := NearestRank.percentilePosition(len(sorted), percentile)
+	return sorted[index]
 }
 
 // calculatePercentileSelection uses quickselect algorithm for efficiency
 // This avoids the O(n log n) cost of full sorting when we only need one percentile
 func calculatePercentileSelection(latencies []uint64, percentile float64) uint64 {
-	data := make([]uint64, len(latencies))
-	copy(data, latencies)
+	data := slices.Clone(latencies)
 
-	k := int(float64(len(data)-1) * (percentile / 100.0))
-	if k >= len(data) {
-		k = len(data) - 1
-	}
-
-	return quickSelect(data, k)
+	index, _, _ := NearestRank.percentilePosition(len(data), percentile)
+	return quickSelect(data, index)
 }
 
-// quickSelect implements the Quickselect algorithm to find the k-th smallest element
-// Average time complexity: O(n), worst case: O(n^2) but rare in practice
+// quickSelect implements introselect to find the k-th smallest element: quickselect
+// with three-way partitioning, so runs of equal values are settled in one pass,
+// falling back to sorting the remaining range once the recursion gets too deep.
+// Time complexity: O(n) on average, O(n log n) worst case
 func quickSelect(arr []uint64, k int) uint64 {
 	left := 0
 	right := len(arr) - 1
+	depthLimit := 2 * bits.Len(uint(len(arr)))
 
 	for {
 		if left == right {
 			return arr[left]
 		}
 
-		pivotIndex := partition(arr, left, right)
-
-		if k == pivotIndex {
+		if depthLimit == 0 {
+			slices.Sort(arr[left : right+1])
 			return arr[k]
-		} else if k < pivotIndex {
-			right = pivotIndex - 1
+		}
+		depthLimit--
+
+		lt, gt := partition(arr, left, right)
+
+		if k < lt {
+			right = lt - 1
+		} else if k > gt {
+			left = gt + 1
 		} else {
-			left = pivotIndex + 1
+			return arr[k]
 		}
 	}
 }
 
-// partition partitions the array around a pivot and returns the pivot's final position
-func partition(arr []uint64, left, right int) int {
-	// Choose middle element as pivot to avoid worst-case behavior
-	pivotIndex := left + (right-left)/2
-	pivot := arr[pivotIndex]
+// multiSelect rearranges arr so that arr[k] is the k-th smallest element for
+// every k in ks, which must be sorted. Each partition step is shared by all
+// order statistics in its range, so a handful of percentiles cost about as much
+// as one.
+func multiSelect(arr []uint64, ks []int) {
+	if len(arr) == 0 || len(ks) == 0 {
+		return
+	}
+	multiSelectRange(arr, 0, len(arr)-1, ks, 2*bits.Len(uint(len(arr))))
+}
+
+// multiSelectRange resolves the order statistics ks, all within arr[left..right]
+func multiSelectRange(arr []uint64, left, right int, ks []int, depthLimit int) {
+	for len(ks) > 0 && left < right {
+		if depthLimit == 0 {
+			slices.Sort(arr[left : right+1])
+			return
+		}
+		depthLimit--
+
+		lt, gt := partition(arr, left, right)
+
+		// ks below the equal range recurse, ks inside it are settled, ks above it continue
+		below, _ := slices.BinarySearch(ks, lt)
+		above, _ := slices.BinarySearch(ks, gt+1)
+		multiSelectRange(arr, left, lt-1, ks[:below], depthLimit)
+
+		ks = ks[above:]
+		left = gt + 1
+	}
+}
 
-	// Move pivot to end
-	arr[pivotIndex], arr[right] = arr[right], arr[pivotIndex]
-	storeIndex := left
+// partition partitions arr[left..right] into elements smaller than, equal to
+// and greater than a pivot, and returns the bounds lt and gt of the equal range
+// arr[lt..gt]
+func partition(arr []uint64, left, right int) (lt, gt int) {
+	// median of three random elements, so no input order is consistently bad
+	n := uint64(right - left + 1)
+	pivot := medianOfThree(
+		arr[left+int(rand.Uint64N(n))],
+		arr[left+int(rand.Uint64N(n))],
+		arr[left+int(rand.Uint64N(n))],
+	)
 
-	for i := left; i < right; i++ {
-		if arr[i] < pivot {
-			arr[storeIndex], arr[i] = arr[i], arr[storeIndex]
-			storeIndex++
+	lt, gt = left, right
+	for i := left; i <= gt; {
+		switch {
+		case arr[i] < pivot:
+			arr[lt], arr[i] = arr[i], arr[lt]
+			lt++
+			i++
+		case arr[i] > pivot:
+			arr[gt], arr[i] = arr[i], arr[gt]
+			gt--
+		default:
+			i++
 		}
 	}
 
-	// Move pivot to its final place
-	arr[storeIndex], arr[right] = arr[right], arr[storeIndex]
-	return storeIndex
+	return lt, gt
+}
+
+// medianOfThree returns the median of a, b and c
+func medianOfThree(a, b, c uint64) uint64 {
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b = c
+	}
+	return max(a, b)
 }
 
 // CalculateMultiplePercentiles efficiently calculates multiple percentiles at once
-// This is more efficient than calling CalculatePercentile multiple times
-func CalculateMultiplePercentiles(latencies []uint64, percentiles []float64) map[float64]uint64 {
+// with the given estimation method. This is more efficient than calling
+// CalculatePercentile multiple times
+func CalculateMultiplePercentiles(latencies []uint64, percentiles []float64, method PercentileMethod) map[float64]uint64 {
 	result := make(map[float64]uint64)
 
 	if len(latencies) == 0 {
@@ -105,27 +252,114 @@ func CalculateMultiplePercentiles(latencies []uint64, percentiles []float64) map
 		return result
 	}
 
-	if len(latencies) <= 1000 {
-		// For small datasets, sort once and get all percentiles
-		sorted := make([]uint64, len(latencies))
-		copy(sorted, latencies)
-		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	data := slices.Clone(latencies)
 
-		for _, percentile := range percentiles {
-			index := float64(len(sorted)-1) * (percentile / 100.0)
-			ceilIndex := int(index)
-			if ceilIndex >= len(sorted) {
-				ceilIndex = len(sorted) - 1
-			}
-			result[percentile] = sorted[ceilIndex]
-		}
+	if len(data) <= 1000 {
+		// For small datasets, sort once and get all percentiles
+		slices.Sort(data)
 	} else {
-		// For larger datasets, calculate each percentile separately
-		// In practice, this is still efficient since our datasets are typically < 10,000 items
+		// For larger datasets, select every needed order statistic in one pass
+		ks := make([]int, 0, 2*len(percentiles))
 		for _, percentile := range percentiles {
-			result[percentile] = calculatePercentileSelection(latencies, percentile)
+			lo, hi, _ := method.percentilePosition(len(data), percentile)
+			ks = append(ks, lo, hi)
+		}
+		slices.Sort(ks)
+		multiSelect(data, slices.Compact(ks))
+	}
+
+	for _, percentile := range percentiles {
+		lo, hi, frac := method.percentilePosition(len(data), percentile)
+		result[percentile] = estimate(data[lo], data[hi], frac)
+	}
+
+	return result
+}
+
+// weightedValues collects values that each stand for weight requests, as
+// samples taken at different sampling rates do. Its percentiles are those of
+// the sample with every value repeated weight times.
+type weightedValues struct {
+	values  []uint64
+	weights []uint64 // nil while every value has the same weight
+	weight  uint64   // the weight shared by all values while weights is nil
+	count   uint64   // total weight
+	sum     uint64   // weighted sum of the values
+}
+
+// add appends value with weight
+func (wv *weightedValues) add(value, weight uint64) {
+	if wv.weights == nil && len(wv.values) > 0 && weight != wv.weight {
+		wv.weights = make([]uint64, len(wv.values), cap(wv.values))
+		for i := range wv.weights {
+			wv.weights[i] = wv.weight
 		}
 	}
+	wv.values = append(wv.values, value)
+	if wv.weights != nil {
+		wv.weights = append(wv.weights, weight)
+	}
+	wv.weight = weight
+	wv.count += weight
+	wv.sum += value * weight
+}
+
+// len returns the number of values added
+func (wv *weightedValues) len() int {
+	return len(wv.values)
+}
+
+// percentiles estimates the percentiles with the given method. With a common
+// weight the repeated sample has the same percentiles as the values themselves.
+func (wv *weightedValues) percentiles(percentiles []float64, method PercentileMethod) map[float64]uint64 {
+	if wv.weights == nil {
+		return CalculateMultiplePercentiles(wv.values, percentiles, method)
+	}
+
+	order := make([]int, len(wv.values))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return cmp.Compare(wv.values[a], wv.values[b]) })
+
+	// cumulative[i] is the number of repeated values up to and including the i-th smallest
+	cumulative := make([]uint64, len(order))
+	var total uint64
+	for i, index := range order {
+		total += wv.weights[index]
+		cumulative[i] = total
+	}
+	// valueAt returns the value at a 0-based position of the repeated sample
+	valueAt := func(position int) uint64 {
+		i, _ := slices.BinarySearch(cumulative, uint64(position)+1)
+		return wv.values[order[i]]
+	}
 
+	result := make(map[float64]uint64, len(percentiles))
+	for _, percentile := range percentiles {
+		lo, hi, frac := method.percentilePosition(int(total), percentile)
+		result[percentile] = estimate(valueAt(lo), valueAt(hi), frac)
+	}
 	return result
 }
+
+// standardPercentiles returns the P50, P95 and P99 of the values
+func (wv *weightedValues) standardPercentiles(method PercentileMethod) (p50, p95, p99 uint64) {
+	result := wv.percentiles(standardPercentiles, method)
+	return result[50], result[95], result[99]
+}
+
+// latencyPercentiles returns the P50, P95 and P99 of latencies in nanoseconds,
+// converted to microseconds
+func (wv *weightedValues) latencyPercentiles(method PercentileMethod) (p50, p95, p99 uint64) {
+	p50, p95, p99 = wv.standardPercentiles(method)
+	return p50 / 1000, p95 / 1000, p99 / 1000
+}
+
+// avgLatency returns the weighted mean of latencies in nanoseconds, in microseconds
+func (wv *weightedValues) avgLatency() float64 {
+	if wv.count == 0 {
+		return 0
+	}
+	return float64(wv.sum) / float64(wv.count) / 1000.0
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// ProbeSpec describes a uprobe attached to every target binary
+type ProbeSpec struct {
+	Symbol   string
+	Program  *ebpf.Program
+	Optional bool // static functions may be inlined or stripped, so a missing symbol is only logged
+}
+
+// binaryAttachment holds the uprobe links of a single executable
+type binaryAttachment struct {
+	key        BinaryKey
+	path       string
+	buildID    string
+	pids       map[uint32]struct{}
+	links      []link.Link
+	cookie     uint64 // identifies the binary to the BPF programs
+	attachedAt time.Time
+}
+
+// ProbeEvent records a probe attach or detach for logs and the status API
+type ProbeEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // "attach" or "detach"
+	Path   string    `json:"path"`
+	Inode  string    `json:"inode"`
+	Reason string    `json:"reason"`
+}
+
+// AttachmentStatus describes a binary that currently has probes attached
+type AttachmentStatus struct {
+	Path       string    `json:"path"`
+	Inode      string    `json:"inode"`
+	BuildID    string    `json:"build_id,omitempty"`
+	Pinned     bool      `json:"pinned"`
+	Processes  int       `json:"processes"`
+	Probes     int       `json:"probes"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+// ProbeManager attaches uprobes once per unique binary and detaches them when
+// the last process using that binary exits
+type ProbeManager struct {
+	mutex        sync.Mutex
+	probes       []ProbeSpec
+	configurator BinaryConfigurator // optional
+	nextCookie   uint64
+	attachments  map[BinaryKey]*binaryAttachment
+	pinnedPaths  map[string]BinaryKey // paths attached explicitly, watched for binary changes
+	missing      map[string]bool      // pinned paths that could not be stat'ed on the last check
+	events       []ProbeEvent
+	maxEvents    int
+	procRoot     string // scanned for processes still running a replaced binary
+}
+
+// NewProbeManager creates a new ProbeManager for the given probes. The
+// configurator, if not nil, is called for every binary before its probes attach.
+func NewProbeManager(probes []ProbeSpec, configurator BinaryConfigurator) *ProbeManager {
+	return &ProbeManager{
+		probes:       probes,
+		configurator: configurator,
+		attachments:  make(map[BinaryKey]*binaryAttachment),
+		pinnedPaths:  make(map[string]BinaryKey),
+		missing:      make(map[string]bool),
+		events:       make([]ProbeEvent, 0, 100),
+		maxEvents:    100,
+		procRoot:     "/proc",
+	}
+}
+
+// AttachPath attaches the probes to the executable at path and keeps them
+// attached regardless of which processes are running. The path is watched by
+// CheckPinned so the probes follow binary upgrades.
+func (pm *ProbeManager) AttachPath(path string) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	// watch the path even if attaching fails now, so CheckPinned retries later
+	pm.pinnedPaths[path] = BinaryKey{}
+
+	key, err := statBinaryKey(path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := pm.attachments[key]; !ok {
+		if _, err := pm.attach(key, path, "", "pinned"); err != nil {
+			return err
+		}
+	}
+	pm.pinnedPaths[path] = key
+	return nil
+}
+
+// CheckPinned re-attaches the probes of every pinned path whose inode changed,
+// e.g. after a package upgrade or an nginx hot binary upgrade (USR2). The
+// replaced binary keeps its probes until no process runs it anymore.
+func (pm *ProbeManager) CheckPinned() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for path, oldKey := range pm.pinnedPaths {
+		key, err := statBinaryKey(path)
+		if err != nil {
+			// the file is briefly missing while package managers replace it
+			if !pm.missing[path] {
+				log.Printf("Watching %s: %v", path, err)
+				pm.missing[path] = true
+			}
+			continue
+		}
+		delete(pm.missing, path)
+
+		if key == oldKey {
+			continue
+		}
+
+		if _, ok := pm.attachments[key]; !ok {
+			if _, err := pm.attach(key, path, "", "binary changed"); err != nil {
+				log.Printf("Re-attaching probes to %s (%s): %v", path, key, err)
+				continue // retry on the next check
+			}
+		}
+		pm.pinnedPaths[path] = key
+	}
+
+	pm.detachReplaced()
+}
+
+// detachReplaced detaches the binaries that are neither pinned nor known to
+// discovery once no process runs them. During an nginx hot upgrade the old
+// master and workers keep serving until they are told to quit, and without
+// discovery nothing else tracks them. Must be called with the mutex held.
+func (pm *ProbeManager) detachReplaced() {
+	var replaced []*binaryAttachment
+	for key, attachment := range pm.attachments {
+		if len(attachment.pids) == 0 && !pm.isPinned(key) {
+			replaced = append(replaced, attachment)
+		}
+	}
+	if len(replaced) == 0 {
+		return
+	}
+
+	running, err := runningBinaries(pm.procRoot)
+	if err != nil {
+		log.Printf("Scanning processes of replaced binaries: %v", err)
+		return
+	}
+	for _, attachment := range replaced {
+		if _, ok := running[attachment.key]; !ok {
+			pm.detach(attachment, "binary replaced")
+		}
+	}
+}
+
+// Sync attaches probes to newly discovered binaries and detaches binaries
+// that are no longer used by any process
+func (pm *ProbeManager) Sync(discovered map[BinaryKey]*DiscoveredBinary) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for key, binary := range discovered {
+		attachment, ok := pm.attachments[key]
+		if !ok {
+			var err error
+			attachment, err = pm.attach(key, binary.Path, binary.BuildID, "discovered")
+			if err != nil {
+				log.Printf("Attaching probes to %s (%s): %v", binary.Path, key, err)
+				continue
+			}
+		}
+		attachment.pids = binary.PIDs
+	}
+
+	for key, attachment := range pm.attachments {
+		if _, ok := discovered[key]; ok {
+			continue
+		}
+		attachment.pids = nil
+		if !pm.isPinned(key) {
+			pm.detach(attachment, "no processes")
+		}
+	}
+}
+
+// AttachedCount returns the number of binaries that currently have probes attached
+func (pm *ProbeManager) AttachedCount() int {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	return len(pm.attachments)
+}
+
+// Attachments returns the status of every binary with probes attached
+func (pm *ProbeManager) Attachments() []AttachmentStatus {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	statuses := make([]AttachmentStatus, 0, len(pm.attachments))
+	for key, attachment := range pm.attachments {
+		statuses = append(statuses, AttachmentStatus{
+			Path:       attachment.path,
+			Inode:      key.String(),
+			BuildID:    attachment.buildID,
+			Pinned:     pm.isPinned(key),
+			Processes:  len(attachment.pids),
+			Probes:     len(attachment.links),
+			AttachedAt: attachment.attachedAt,
+		})
+	}
+	return statuses
+}
+
+// Events returns the most recent attach and detach events, oldest first
+func (pm *ProbeManager) Events() []ProbeEvent {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	events := make([]ProbeEvent, len(pm.events))
+	copy(events, pm.events)
+	return events
+}
+
+// Close detaches all probes
+func (pm *ProbeManager) Close() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for _, attachment := range pm.attachments {
+		pm.detach(attachment, "shutdown")
+	}
+}
+
+// isPinned reports whether any pinned path currently resolves to key. Must be called with the mutex held.
+func (pm *ProbeManager) isPinned(key BinaryKey) bool {
+	for _, pinnedKey := range pm.pinnedPaths {
+		if pinnedKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// attach opens the executable and attaches every probe. Must be called with the mutex held.
+func (pm *ProbeManager) attach(key BinaryKey, path, buildID, reason string) (*binaryAttachment, error) {
+	executable, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening executable: %w", err)
+	}
+	if buildID == "" {
+		buildID = fileBuildID(path)
+	}
+
+	attachment := &binaryAttachment{
+		key:        key,
+		path:       path,
+		buildID:    buildID,
+		cookie:     pm.nextCookie,
+		attachedAt: time.Now().UTC(),
+	}
+	pm.nextCookie++
+
+	if pm.configurator != nil {
+		if err := pm.configurator.Configure(attachment.cookie, path); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &link.UprobeOptions{Cookie: attachment.cookie}
+	for _, probe := range pm.probes {
+		l, err := executable.Uprobe(probe.Symbol, probe.Program, opts)
+		if err != nil {
+			if probe.Optional {
+				log.Printf("Skipping optional uprobe '%s' on %s: %v", probe.Symbol, path, err)
+				continue
+			}
+			closeLinks(attachment.links)
+			pm.release(attachment)
+			return nil, fmt.Errorf("opening uprobe '%s': %w", probe.Symbol, err)
+		}
+		attachment.links = append(attachment.links, l)
+	}
+
+	pm.attachments[key] = attachment
+	pm.recordEvent("attach", attachment, reason)
+	log.Printf("Attached %d probes to %s (inode %s, build-id %q): %s", len(attachment.links), path, key, buildID, reason)
+	return attachment, nil
+}
+
+// detach closes the probes of a binary. Must be called with the mutex held.
+func (pm *ProbeManager) detach(attachment *binaryAttachment, reason string) {
+	if err := closeLinks(attachment.links); err != nil {
+		log.Printf("Detaching probes from %s: %v", attachment.path, err)
+	}
+	pm.release(attachment)
+	delete(pm.attachments, attachment.key)
+	pm.recordEvent("detach", attachment, reason)
+	log.Printf("Detached probes from %s (inode %s): %s", attachment.path, attachment.key, reason)
+}
+
+// release frees the per-binary state of the configurator. Must be called with the mutex held.
+func (pm *ProbeManager) release(attachment *binaryAttachment) {
+	if pm.configurator != nil {
+		pm.configurator.Release(attachment.cookie)
+	}
+}
+
+// recordEvent appends to the bounded event history. Must be called with the mutex held.
+func (pm *ProbeManager) recordEvent(action string, attachment *binaryAttachment, reason string) {
+	if len(pm.events) >= pm.maxEvents {
+		pm.events = pm.events[1:]
+	}
+	pm.events = append(pm.events, ProbeEvent{
+		Time:   time.Now().UTC(),
+		Action: action,
+		Path:   attachment.path,
+		Inode:  attachment.key.String(),
+		Reason: reason,
+	})
+}
+
+// closeLinks closes all links and returns the combined error
+func closeLinks(links []link.Link) error {
+	var errs []error
+	for _, l := range links {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
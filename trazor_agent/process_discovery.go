@@ -0,0 +1,233 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// BinaryKey identifies an executable by device and inode, so the same binary
+// seen through different mount namespaces is only probed once
+type BinaryKey struct {
+	Dev   uint64
+	Inode uint64
+}
+
+func (k BinaryKey) String() string {
+	return fmt.Sprintf("%d:%d", k.Dev, k.Inode)
+}
+
+// DiscoveredBinary is a matching executable together with the processes running it
+type DiscoveredBinary struct {
+	Key     BinaryKey
+	Path    string // path usable from the host, e.g. /proc/<pid>/root/usr/sbin/nginx
+	BuildID string
+	PIDs    map[uint32]struct{}
+}
+
+// binaryMatch caches the result of inspecting an executable
+type binaryMatch struct {
+	matches bool
+	buildID string
+}
+
+// ProcessDiscovery scans /proc for processes whose executable exports all of
+// the required symbols, including processes inside container mount namespaces
+type ProcessDiscovery struct {
+	procRoot string
+	symbols  []string
+	cache    map[BinaryKey]binaryMatch
+}
+
+// NewProcessDiscovery creates a new ProcessDiscovery matching binaries that contain all symbols
+func NewProcessDiscovery(symbols []string) *ProcessDiscovery {
+	return &ProcessDiscovery{
+		procRoot: "/proc",
+		symbols:  symbols,
+		cache:    make(map[BinaryKey]binaryMatch),
+	}
+}
+
+// Scan walks /proc and returns every matching binary keyed by device and inode
+func (pd *ProcessDiscovery) Scan() (map[BinaryKey]*DiscoveredBinary, error) {
+	entries, err := os.ReadDir(pd.procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[BinaryKey]*DiscoveredBinary)
+	seen := make(map[BinaryKey]struct{})
+
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue // not a process directory
+		}
+
+		exeLink := filepath.Join(pd.procRoot, entry.Name(), "exe")
+
+		// stat follows the magic link into the process' mount namespace
+		key, err := statBinaryKey(exeLink)
+		if err != nil {
+			continue // kernel thread, exited process or no permission
+		}
+		seen[key] = struct{}{}
+
+		match, ok := pd.cache[key]
+		if !ok {
+			match = pd.inspect(exeLink)
+			pd.cache[key] = match
+		}
+		if !match.matches {
+			continue
+		}
+
+		binary, ok := found[key]
+		if !ok {
+			binary = &DiscoveredBinary{
+				Key:     key,
+				Path:    pd.hostPath(entry.Name(), exeLink, key),
+				BuildID: match.buildID,
+				PIDs:    make(map[uint32]struct{}),
+			}
+			found[key] = binary
+		}
+		binary.PIDs[uint32(pid)] = struct{}{}
+	}
+
+	// Forget binaries that are no longer running so the cache stays bounded
+	for key := range pd.cache {
+		if _, ok := seen[key]; !ok {
+			delete(pd.cache, key)
+		}
+	}
+
+	return found, nil
+}
+
+// inspect checks whether the executable exports every required symbol
+func (pd *ProcessDiscovery) inspect(path string) binaryMatch {
+	f, err := elf.Open(path)
+	if err != nil {
+		return binaryMatch{}
+	}
+	defer f.Close()
+
+	if !hasSymbols(f, pd.symbols) {
+		return binaryMatch{}
+	}
+
+	return binaryMatch{matches: true, buildID: readBuildID(f)}
+}
+
+// hostPath resolves the executable through /proc/<pid>/root so binaries inside
+// containers can be opened from the host. Falls back to /proc/<pid>/exe when
+// the file was replaced or deleted since the process started.
+func (pd *ProcessDiscovery) hostPath(pid, exeLink string, key BinaryKey) string {
+	target, err := os.Readlink(exeLink)
+	if err != nil || strings.HasSuffix(target, " (deleted)") {
+		return exeLink
+	}
+
+	path := filepath.Join(pd.procRoot, pid, "root", target)
+	if rootKey, err := statBinaryKey(path); err != nil || rootKey != key {
+		return exeLink
+	}
+	return path
+}
+
+// runningBinaries returns the executables of every process under procRoot
+func runningBinaries(procRoot string) (map[BinaryKey]struct{}, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	running := make(map[BinaryKey]struct{})
+	for _, entry := range entries {
+		if _, err := strconv.ParseUint(entry.Name(), 10, 32); err != nil {
+			continue // not a process directory
+		}
+		if key, err := statBinaryKey(filepath.Join(procRoot, entry.Name(), "exe")); err == nil {
+			running[key] = struct{}{}
+		}
+	}
+	return running, nil
+}
+
+// statBinaryKey returns the device and inode of the file at path
+func statBinaryKey(path string) (BinaryKey, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return BinaryKey{}, err
+	}
+	return BinaryKey{Dev: uint64(st.Dev), Inode: st.Ino}, nil
+}
+
+// hasSymbols reports whether all symbols are defined as functions in the ELF file
+func hasSymbols(f *elf.File, symbols []string) bool {
+	want := make(map[string]struct{}, len(symbols))
+	for _, s := range symbols {
+		want[s] = struct{}{}
+	}
+
+	for _, load := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+		syms, err := load()
+		if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+			return false
+		}
+		for _, s := range syms {
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 {
+				delete(want, s.Name)
+			}
+		}
+		if len(want) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileBuildID returns the build-id of the executable at path, or "" if it can't be read
+func fileBuildID(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return readBuildID(f)
+}
+
+// readBuildID returns the hex-encoded GNU build-id note, or "" if there is none
+func readBuildID(f *elf.File) string {
+	section := f.Section(".note.gnu.build-id")
+	if section == nil {
+		return ""
+	}
+
+	data, err := section.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+
+	// Note layout: namesz, descsz, type, name ("GNU\0"), desc
+	nameSize := f.ByteOrder.Uint32(data[0:4])
+	descSize := f.ByteOrder.Uint32(data[4:8])
+	noteType := f.ByteOrder.Uint32(data[8:12])
+	if noteType != 3 { // NT_GNU_BUILD_ID
+		return ""
+	}
+
+	descStart := 12 + int((nameSize+3)&^3)
+	if descStart+int(descSize) > len(data) {
+		return ""
+	}
+	return hex.EncodeToString(data[descStart : descStart+int(descSize)])
+}
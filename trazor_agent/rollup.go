@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rollup merges consecutive windows into one window of a coarser resolution.
+// Only mergeable state is kept: counters, the latency histogram and sketches
+// for the percentiles and averages.
+type rollup struct {
+	resolution time.Duration
+	merged     *WindowMetrics // windows merged so far, nil while empty
+	sketches   *windowSketches
+}
+
+// ParseRollups parses a comma-separated list of rollup resolutions such as
+// "1m,5m,1h". Each must be a multiple of the previous one, the first a multiple
+// of the base window.
+func ParseRollups(list string, window time.Duration) ([]time.Duration, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var resolutions []time.Duration
+	previous := window
+	for field := range strings.SplitSeq(list, ",") {
+		resolution, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup resolution %q", field)
+		}
+		if resolution <= previous || resolution%previous != 0 {
+			return nil, fmt.Errorf("rollup resolution %v is not a multiple of %v", resolution, previous)
+		}
+		resolutions = append(resolutions, resolution)
+		previous = resolution
+	}
+	return resolutions, nil
+}
+
+// formatResolution formats a window duration as "10s", "1m" or "1h"
+func formatResolution(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// add merges the metrics of a finer window, which must carry its sketches
+// unless it is an empty heartbeat window
+func (r *rollup) add(metrics *WindowMetrics) {
+	if r.merged == nil {
+		r.merged = NewWindowMetrics()
+		r.merged.WindowStart = metrics.WindowStart - metrics.WindowStart%int64(r.resolution)
+		r.merged.Series = metrics.Series
+		r.sketches = newWindowSketches()
+	}
+	merged := r.merged
+
+	merged.TotalRequests += metrics.TotalRequests
+	merged.ExactRequests += metrics.ExactRequests
+	merged.DroppedEvents += metrics.DroppedEvents
+	if metrics.SampledRequests > 0 {
+		if merged.SampledRequests == 0 || metrics.MinLatency < merged.MinLatency {
+			merged.MinLatency = metrics.MinLatency
+		}
+		merged.MaxLatency = max(merged.MaxLatency, metrics.MaxLatency)
+		merged.SampledRequests += metrics.SampledRequests
+		r.sketches.merge(metrics.sketches)
+	}
+
+	for pid, requests := range metrics.ProcessBreakdown {
+		merged.ProcessBreakdown[pid] += requests
+	}
+
+	if histogram := metrics.LatencyHistogram; histogram != nil {
+		if merged.LatencyHistogram == nil {
+			merged.LatencyHistogram = &LatencyHistogram{
+				Layout: histogram.Layout,
+				Bounds: histogram.Bounds,
+				Counts: make([]uint64, len(histogram.Counts)),
+			}
+		}
+		// the layout is fixed at startup, so the bounds always match
+		merged.LatencyHistogram.Merge(histogram)
+	}
+
+	merged.RequestBytes += metrics.RequestBytes
+	merged.ResponseBytes += metrics.ResponseBytes
+
+	for class, requests := range metrics.StatusClasses {
+		merged.StatusClasses[class] += requests
+	}
+	for status, requests := range metrics.StatusCodes {
+		merged.StatusCodes[status] += requests
+	}
+	merged.ErrorRequests += metrics.ErrorRequests
+	merged.UpstreamRequests += metrics.UpstreamRequests
+
+	// the slowest requests of the rollup are among the slowest of its windows
+	if len(metrics.Exemplars) > 0 {
+		count := max(len(merged.Exemplars), len(metrics.Exemplars))
+		merged.Exemplars = append(merged.Exemplars, metrics.Exemplars...)
+		slices.SortStableFunc(merged.Exemplars, func(a, b Exemplar) int {
+			return cmp.Compare(b.LatencyUs, a.LatencyUs)
+		})
+		merged.Exemplars = merged.Exemplars[:count]
+	}
+
+	if len(metrics.SlowStacks) > 0 {
+		merged.SlowStacks = mergeFoldedStacks(merged.SlowStacks, metrics.SlowStacks)
+	}
+}
+
+// close finishes the rollup window ending at end and resets the rollup. It
+// returns nil if no window was merged.
+func (r *rollup) close(end int64, percentiles []float64) *WindowMetrics {
+	metrics := r.merged
+	if metrics == nil {
+		return nil
+	}
+	r.merged = nil
+
+	metrics.WindowEnd = end
+	metrics.Resolution = formatResolution(r.resolution)
+	metrics.PercentileMethod = "sketch"
+	metrics.sketches = r.sketches
+	sketches := r.sketches
+
+	if metrics.SampledRequests > 0 {
+		metrics.AvgLatency = sketches.latency.Mean() / 1000
+		metrics.SampleRate = float64(metrics.TotalRequests) / float64(metrics.SampledRequests)
+	}
+
+	// the sketches hold latencies in nanoseconds, weighted by the sampling rate
+	all := sketches.latency.Quantiles(slices.Concat(percentiles, standardPercentiles))
+	metrics.P50Latency = all[50] / 1000
+	metrics.P95Latency = all[95] / 1000
+	metrics.P99Latency = all[99] / 1000
+	for _, percentile := range percentiles {
+		metrics.Percentiles[PercentileLabel(percentile)] = all[percentile] / 1000
+	}
+	if sketches.nginx.Count() > 0 {
+		metrics.NginxP50Latency, metrics.NginxP95Latency, metrics.NginxP99Latency = sketches.nginx.latencyPercentiles()
+	}
+	if sketches.ttfb.Count() > 0 {
+		metrics.TTFBP50Latency, metrics.TTFBP95Latency, metrics.TTFBP99Latency = sketches.ttfb.latencyPercentiles()
+	}
+	if sketches.success.Count() > 0 {
+		metrics.SuccessP50Latency, metrics.SuccessP95Latency, metrics.SuccessP99Latency = sketches.success.latencyPercentiles()
+	}
+	if sketches.errors.Count() > 0 {
+		metrics.ErrorP50Latency, metrics.ErrorP95Latency, metrics.ErrorP99Latency = sketches.errors.latencyPercentiles()
+	}
+
+	if sketches.upstream.Count() > 0 {
+		metrics.UpstreamP50Latency, metrics.UpstreamP95Latency, metrics.UpstreamP99Latency = sketches.upstream.latencyPercentiles()
+		for addr, sketch := range sketches.upstreamByAddr {
+			upstream := &UpstreamMetrics{Requests: sketch.Count(), AvgLatency: sketch.Mean() / 1000}
+			upstream.P50Latency, upstream.P95Latency, upstream.P99Latency = sketch.latencyPercentiles()
+			metrics.UpstreamBreakdown[addr] = upstream
+		}
+	}
+
+	if sketches.responseSizes.Count() > 0 {
+		metrics.RequestSizeP50, metrics.RequestSizeP95, metrics.RequestSizeP99 = sketches.requestSizes.standardPercentiles()
+		metrics.ResponseSizeP50, metrics.ResponseSizeP95, metrics.ResponseSizeP99 = sketches.responseSizes.standardPercentiles()
+		for i, sketch := range sketches.latencyBySize {
+			if sketch.Count() == 0 {
+				continue
+			}
+			bucket := &SizeBucketMetrics{
+				Bucket:     responseSizeBuckets[i].label,
+				MaxBytes:   responseSizeBuckets[i].maxBytes,
+				Requests:   sketch.Count(),
+				AvgLatency: sketch.Mean() / 1000,
+			}
+			bucket.P50Latency, bucket.P95Latency, bucket.P99Latency = sketch.latencyPercentiles()
+			metrics.LatencyByResponseSize = append(metrics.LatencyByResponseSize, bucket)
+		}
+	}
+
+	seconds := r.resolution.Seconds()
+	metrics.RequestThroughput = float64(metrics.RequestBytes) / seconds
+	metrics.ResponseThroughput = float64(metrics.ResponseBytes) / seconds
+
+	var knownStatusRequests uint64
+	for requests := range maps.Values(metrics.StatusClasses) {
+		knownStatusRequests += requests
+	}
+	if knownStatusRequests > 0 {
+		metrics.ErrorRatio = float64(metrics.ErrorRequests) / float64(knownStatusRequests)
+	}
+
+	return metrics
+}
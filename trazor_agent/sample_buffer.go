@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// sampleShard holds the samples of the PIDs mapped to it. Shards are locked
+// independently, so consumers of different workers do not contend.
+type sampleShard struct {
+	mutex   sync.Mutex
+	sealed  bool                       // set once the window was rotated out
+	samples map[uint32][]LatencySample // PID → samples
+	slowest exemplarHeap               // slowest samples of the shard
+	_       [64]byte                   // keep shards on separate cache lines
+}
+
+// exemplarHeap is a min-heap of samples by latency: its root is the fastest of
+// the slowest samples kept, the one replaced by a slower sample
+type exemplarHeap []LatencySample
+
+func (h exemplarHeap) Len() int           { return len(h) }
+func (h exemplarHeap) Less(i, j int) bool { return h[i].LatencyNs < h[j].LatencyNs }
+func (h exemplarHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *exemplarHeap) Push(x any)        { *h = append(*h, x.(LatencySample)) }
+func (h *exemplarHeap) Pop() any {
+	old := *h
+	sample := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return sample
+}
+
+// offer keeps sample if it is among the k slowest seen so far
+func (h *exemplarHeap) offer(sample LatencySample, k int) {
+	if len(*h) < k {
+		heap.Push(h, sample)
+	} else if k > 0 && sample.LatencyNs > (*h)[0].LatencyNs {
+		(*h)[0] = sample
+		heap.Fix(h, 0)
+	}
+}
+
+// windowBuffer is the set of shards of one window
+type windowBuffer struct {
+	shards []sampleShard
+}
+
+// newWindowBuffer creates a windowBuffer with one shard per usable CPU
+func newWindowBuffer() *windowBuffer {
+	shards := make([]sampleShard, runtime.GOMAXPROCS(0))
+	for i := range shards {
+		shards[i].samples = make(map[uint32][]LatencySample)
+	}
+	return &windowBuffer{shards: shards}
+}
+
+// add appends sample to its shard and keeps it as an exemplar if it is among
+// the maxExemplars slowest of the shard. It returns false if the buffer was sealed.
+func (wb *windowBuffer) add(sample LatencySample, maxExemplars int) bool {
+	shard := &wb.shards[int(sample.ProcessID)%len(wb.shards)]
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.sealed {
+		return false
+	}
+
+	shard.samples[sample.ProcessID] = append(shard.samples[sample.ProcessID], sample)
+
+	shard.slowest.offer(sample, maxExemplars)
+	return true
+}
+
+// seal stops ingestion into every shard and returns their samples merged by PID,
+// and the maxExemplars slowest samples of the window, slowest first. Writers
+// that still hold the buffer see the sealed flag and retry on the new one.
+func (wb *windowBuffer) seal(maxExemplars int) (map[uint32][]LatencySample, []LatencySample) {
+	merged := make(map[uint32][]LatencySample)
+	var slowest []LatencySample
+
+	for i := range wb.shards {
+		shard := &wb.shards[i]
+		shard.mutex.Lock()
+		shard.sealed = true
+		for processID, samples := range shard.samples {
+			merged[processID] = samples
+		}
+		slowest = append(slowest, shard.slowest...)
+		shard.mutex.Unlock()
+	}
+
+	// every shard kept its own slowest, the window's are among them
+	slices.SortFunc(slowest, func(a, b LatencySample) int {
+		return cmp.Compare(b.LatencyNs, a.LatencyNs)
+	})
+	if len(slowest) > maxExemplars {
+		slowest = slowest[:maxExemplars]
+	}
+	return merged, slowest
+}
+
+// count returns the number of samples in the buffer
+func (wb *windowBuffer) count() int {
+	count := 0
+	for i := range wb.shards {
+		shard := &wb.shards[i]
+		shard.mutex.Lock()
+		for _, samples := range shard.samples {
+			count += len(samples)
+		}
+		shard.mutex.Unlock()
+	}
+	return count
+}
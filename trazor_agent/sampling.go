@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// RequestSampler controls kernel-side 1-in-N sampling of completed requests
+// and reads the exact number of requests seen by the BPF programs
+type RequestSampler struct {
+	rate        *ebpf.Variable
+	completed   *ebpf.Map
+	dropped     *ebpf.Map
+	lastCount   uint64
+	lastDropped uint64
+}
+
+// NewRequestSampler creates a new RequestSampler from the sample_rate global
+// and the per-CPU request_count and dropped_events maps
+func NewRequestSampler(rate *ebpf.Variable, completed, dropped *ebpf.Map) *RequestSampler {
+	return &RequestSampler{rate: rate, completed: completed, dropped: dropped}
+}
+
+// SetRate submits 1 in rate completed requests to the ringbuf, 1 disables sampling
+func (rs *RequestSampler) SetRate(rate uint32) error {
+	if rate == 0 {
+		return fmt.Errorf("sample rate must be at least 1")
+	}
+	return rs.rate.Set(rate)
+}
+
+// CountsSince returns the number of completed requests, sampled or not, and
+// of events dropped because the ringbuf was full since the previous call
+func (rs *RequestSampler) CountsSince() (completed, dropped uint64, err error) {
+	completedTotal, err := sumPerCPU(rs.completed)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading request count: %w", err)
+	}
+	droppedTotal, err := sumPerCPU(rs.dropped)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading dropped events: %w", err)
+	}
+
+	completed, dropped = completedTotal-rs.lastCount, droppedTotal-rs.lastDropped
+	rs.lastCount, rs.lastDropped = completedTotal, droppedTotal
+	return completed, dropped, nil
+}
+
+// sumPerCPU adds up the per-CPU values of the single slot of a per-CPU array
+func sumPerCPU(m *ebpf.Map) (uint64, error) {
+	var perCPU []uint64
+	if err := m.Lookup(uint32(0), &perCPU); err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, value := range perCPU {
+		total += value
+	}
+	return total, nil
+}
+
+// AdaptiveSampler keeps the submitted events within an events-per-second
+// budget. The rate is recomputed at window boundaries, so every window is
+// sampled uniformly, and only raised mid-window when the ringbuf fills up.
+type AdaptiveSampler struct {
+	mutex   sync.Mutex
+	sampler *RequestSampler
+	ringBuf *ringbuf.Reader
+	budget  float64 // events per second
+	maxRate uint32
+	rate    uint32
+}
+
+// NewAdaptiveSampler creates a new AdaptiveSampler starting at initialRate
+func NewAdaptiveSampler(sampler *RequestSampler, ringBuf *ringbuf.Reader, budget float64, initialRate, maxRate uint32) *AdaptiveSampler {
+	return &AdaptiveSampler{
+		sampler: sampler,
+		ringBuf: ringBuf,
+		budget:  budget,
+		maxRate: maxRate,
+		rate:    initialRate,
+	}
+}
+
+// Adjust picks the rate of the next window from the request rate and the
+// drops of the window that just ended
+func (as *AdaptiveSampler) Adjust(completed, dropped uint64, elapsed time.Duration) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	requestRate := float64(completed) / elapsed.Seconds()
+	rate := nextSampleRate(as.rate, requestRate, as.budget, dropped > 0, as.maxRate)
+	as.setRate(rate, fmt.Sprintf("%.0f req/s, %d dropped", requestRate, dropped))
+}
+
+// CheckPressure doubles the rate right away when the ringbuf is more than half full
+func (as *AdaptiveSampler) CheckPressure() {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	available := as.ringBuf.AvailableBytes()
+	if available <= as.ringBuf.BufferSize()/2 {
+		return
+	}
+	rate := doubledRate(as.rate, as.maxRate)
+	as.setRate(rate, fmt.Sprintf("ringbuf %d/%d bytes", available, as.ringBuf.BufferSize()))
+}
+
+// setRate applies a new rate, must be called with the mutex held
+func (as *AdaptiveSampler) setRate(rate uint32, reason string) {
+	if rate == as.rate {
+		return
+	}
+	if err := as.sampler.SetRate(rate); err != nil {
+		log.Printf("Setting sample rate: %v", err)
+		return
+	}
+	log.Printf("Sample rate 1/%d -> 1/%d (%s)", as.rate, rate, reason)
+	as.rate = rate
+}
+
+// doubledRate doubles rate up to maxRate without overflowing uint32
+func doubledRate(rate, maxRate uint32) uint32 {
+	return uint32(min(uint64(rate)*2, uint64(maxRate)))
+}
+
+// nextSampleRate returns the 1-in-N rate that brings requestRate within budget
+// events per second. The rate doubles at least on drops and is lowered by at
+// most half per step, so bursts do not make it oscillate.
+func nextSampleRate(current uint32, requestRate, budget float64, dropped bool, maxRate uint32) uint32 {
+	rate := uint32(min(math.Ceil(requestRate/budget), float64(maxRate)))
+	if dropped {
+		rate = max(rate, doubledRate(current, maxRate))
+	}
+	if rate < current {
+		rate = max(rate, current/2)
+	}
+	return min(max(rate, 1), maxRate)
+}
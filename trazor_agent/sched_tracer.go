@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// SchedTracer attaches the programs that split the latency of nginx requests
+// into on-CPU, run-queue and blocked time. They run on every context switch and
+// wakeup of the host, so they are only attached with -sched-breakdown.
+type SchedTracer struct {
+	links []link.Link
+}
+
+// NewSchedTracer attaches schedSwitch and schedWakeup to the sched:sched_switch
+// and sched:sched_wakeup tracepoints
+func NewSchedTracer(schedSwitch, schedWakeup *ebpf.Program) (*SchedTracer, error) {
+	st := &SchedTracer{}
+	for _, tracepoint := range []struct {
+		name    string
+		program *ebpf.Program
+	}{
+		{"sched_switch", schedSwitch},
+		{"sched_wakeup", schedWakeup},
+	} {
+		l, err := link.Tracepoint("sched", tracepoint.name, tracepoint.program, nil)
+		if err != nil {
+			st.Close()
+			return nil, fmt.Errorf("attaching sched:%s: %w", tracepoint.name, err)
+		}
+		st.links = append(st.links, l)
+	}
+	return st, nil
+}
+
+// Close detaches the tracepoints
+func (st *SchedTracer) Close() error {
+	err := closeLinks(st.links)
+	st.links = nil
+	return err
+}
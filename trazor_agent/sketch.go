@@ -0,0 +1,202 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+)
+
+// sketchAccuracy is the relative error bound of LatencySketch quantiles
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// LatencySketch is a mergeable quantile sketch with a relative error guarantee
+// (DDSketch). Values are counted in logarithmic buckets whose bounds grow by
+// gamma, so every quantile is estimated within sketchAccuracy of the true value,
+// and the sketches of several windows merge exactly by adding bucket counts.
+type LatencySketch struct {
+	buckets   map[int]uint64 // bucket index → count, bucket i holds (gamma^(i-1), gamma^i]
+	zeroCount uint64
+	count     uint64
+	sum       float64 // weighted sum of the values, for Mean
+	min       uint64
+	max       uint64
+}
+
+// NewLatencySketch creates an empty LatencySketch
+func NewLatencySketch() *LatencySketch {
+	return &LatencySketch{buckets: make(map[int]uint64)}
+}
+
+// Add counts weight occurrences of value
+func (s *LatencySketch) Add(value, weight uint64) {
+	if weight == 0 {
+		return
+	}
+	if value == 0 {
+		s.zeroCount += weight
+	} else {
+		s.buckets[int(math.Ceil(math.Log(float64(value))/sketchLogGamma))] += weight
+	}
+
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count += weight
+	s.sum += float64(value) * float64(weight)
+}
+
+// Merge adds the counts of other
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	if other.count == 0 {
+		return
+	}
+	for index, count := range other.buckets {
+		s.buckets[index] += count
+	}
+	s.zeroCount += other.zeroCount
+
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+}
+
+// Count returns the total weight added to the sketch
+func (s *LatencySketch) Count() uint64 {
+	return s.count
+}
+
+// Mean returns the exact weighted mean of the values, 0 if empty
+func (s *LatencySketch) Mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+// Quantiles estimates the nearest-rank percentiles of the sketch in one pass over its buckets
+func (s *LatencySketch) Quantiles(percentiles []float64) map[float64]uint64 {
+	result := make(map[float64]uint64, len(percentiles))
+	if s.count == 0 {
+		for _, percentile := range percentiles {
+			result[percentile] = 0
+		}
+		return result
+	}
+
+	sorted := slices.Clone(percentiles)
+	slices.Sort(sorted)
+	indexes := slices.Sorted(maps.Keys(s.buckets))
+
+	cumulative := s.zeroCount
+	next := 0 // next bucket to add to cumulative
+	for _, percentile := range sorted {
+		rank := max(uint64(math.Ceil(float64(s.count)*percentile/100-1e-9)), 1)
+		if rank <= s.zeroCount {
+			result[percentile] = 0
+			continue
+		}
+		for cumulative < rank && next < len(indexes) {
+			cumulative += s.buckets[indexes[next]]
+			next++
+		}
+		// the representative of (gamma^(i-1), gamma^i] is within sketchAccuracy of any value in it
+		value := 2 * math.Pow(sketchGamma, float64(indexes[next-1])) / (sketchGamma + 1)
+		result[percentile] = min(max(uint64(math.Round(value)), s.min), s.max)
+	}
+	return result
+}
+
+// standardPercentiles returns the P50, P95 and P99 of the sketch
+func (s *LatencySketch) standardPercentiles() (p50, p95, p99 uint64) {
+	result := s.Quantiles(standardPercentiles)
+	return result[50], result[95], result[99]
+}
+
+// latencyPercentiles returns the P50, P95 and P99 of a sketch of latencies in
+// nanoseconds, converted to microseconds
+func (s *LatencySketch) latencyPercentiles() (p50, p95, p99 uint64) {
+	p50, p95, p99 = s.standardPercentiles()
+	return p50 / 1000, p95 / 1000, p99 / 1000
+}
+
+// sketch returns a sketch of the values, each counted with its weight
+func (wv *weightedValues) sketch() *LatencySketch {
+	sketch := NewLatencySketch()
+	for i, value := range wv.values {
+		weight := wv.weight
+		if wv.weights != nil {
+			weight = wv.weights[i]
+		}
+		sketch.Add(value, weight)
+	}
+	return sketch
+}
+
+// windowSketches are the distributions of a window that rollups and hopping
+// windows merge, one for every set of percentiles of WindowMetrics
+type windowSketches struct {
+	latency        *LatencySketch
+	nginx          *LatencySketch
+	ttfb           *LatencySketch
+	upstream       *LatencySketch
+	upstreamByAddr map[string]*LatencySketch
+	success        *LatencySketch
+	errors         *LatencySketch
+	requestSizes   *LatencySketch
+	responseSizes  *LatencySketch
+	latencyBySize  []*LatencySketch // by responseSizeBuckets index
+}
+
+// newWindowSketches creates empty windowSketches
+func newWindowSketches() *windowSketches {
+	ws := &windowSketches{
+		latency:        NewLatencySketch(),
+		nginx:          NewLatencySketch(),
+		ttfb:           NewLatencySketch(),
+		upstream:       NewLatencySketch(),
+		upstreamByAddr: make(map[string]*LatencySketch),
+		success:        NewLatencySketch(),
+		errors:         NewLatencySketch(),
+		requestSizes:   NewLatencySketch(),
+		responseSizes:  NewLatencySketch(),
+		latencyBySize:  make([]*LatencySketch, len(responseSizeBuckets)),
+	}
+	for i := range ws.latencyBySize {
+		ws.latencyBySize[i] = NewLatencySketch()
+	}
+	return ws
+}
+
+// merge adds the counts of other
+func (ws *windowSketches) merge(other *windowSketches) {
+	ws.latency.Merge(other.latency)
+	ws.nginx.Merge(other.nginx)
+	ws.ttfb.Merge(other.ttfb)
+	ws.upstream.Merge(other.upstream)
+	for addr, sketch := range other.upstreamByAddr {
+		if ws.upstreamByAddr[addr] == nil {
+			ws.upstreamByAddr[addr] = NewLatencySketch()
+		}
+		ws.upstreamByAddr[addr].Merge(sketch)
+	}
+	ws.success.Merge(other.success)
+	ws.errors.Merge(other.errors)
+	ws.requestSizes.Merge(other.requestSizes)
+	ws.responseSizes.Merge(other.responseSizes)
+	for i, sketch := range other.latencyBySize {
+		ws.latencyBySize[i].Merge(sketch)
+	}
+}
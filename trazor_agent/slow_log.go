@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// slowLogEntry is one line of the slow request log
+type slowLogEntry struct {
+	Exemplar
+	Series string `json:"series,omitempty"` // traced function, empty for HTTP requests
+}
+
+// SlowLog appends every request slower than a threshold to a JSONL file. When
+// the file would grow past maxBytes it is rotated to path.1, path.1 to path.2
+// and so on, keeping maxFiles rotated files.
+type SlowLog struct {
+	mutex     sync.Mutex
+	path      string
+	threshold uint64 // nanoseconds
+	maxBytes  int64
+	maxFiles  int
+	file      *os.File // nil after Close or a failed rotation
+	closed    bool
+	size      int64
+	line      bytes.Buffer // reused encoding buffer
+	encoder   *json.Encoder
+}
+
+// NewSlowLog opens or creates the slow log at path, appending to an existing file
+func NewSlowLog(path string, threshold time.Duration, maxBytes int64, maxFiles int) (*SlowLog, error) {
+	if threshold <= 0 || maxBytes <= 0 || maxFiles < 0 {
+		return nil, fmt.Errorf("slow log needs a positive threshold and size, got %v and %d bytes", threshold, maxBytes)
+	}
+
+	sl := &SlowLog{
+		path:      path,
+		threshold: uint64(threshold),
+		maxBytes:  maxBytes,
+		maxFiles:  maxFiles,
+	}
+	sl.encoder = json.NewEncoder(&sl.line)
+	if err := sl.open(); err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+// open opens the log file for appending and reads its current size
+func (sl *SlowLog) open() error {
+	file, err := os.OpenFile(sl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening slow log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening slow log: %w", err)
+	}
+
+	sl.file = file
+	sl.size = info.Size()
+	return nil
+}
+
+// Record appends sample to the log if it is slower than the threshold. Each
+// entry is written with a single write, so it is complete once Record returns.
+func (sl *SlowLog) Record(sample *LatencySample, series string) error {
+	if sample.LatencyNs < sl.threshold {
+		return nil
+	}
+
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if sl.closed {
+		return os.ErrClosed
+	}
+	if sl.file == nil {
+		// a previous rotation failed, try again with a fresh file
+		if err := sl.open(); err != nil {
+			return err
+		}
+	}
+
+	sl.line.Reset()
+	if err := sl.encoder.Encode(slowLogEntry{Exemplar: newExemplar(sample), Series: series}); err != nil {
+		return err
+	}
+
+	if sl.size > 0 && sl.size+int64(sl.line.Len()) > sl.maxBytes {
+		if err := sl.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := sl.file.Write(sl.line.Bytes())
+	sl.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated files by one, moves the log to path.1 and starts a new one
+func (sl *SlowLog) rotate() error {
+	if err := sl.file.Close(); err != nil {
+		return fmt.Errorf("rotating slow log: %w", err)
+	}
+	sl.file = nil
+
+	if sl.maxFiles == 0 {
+		if err := os.Remove(sl.path); err != nil {
+			return fmt.Errorf("rotating slow log: %w", err)
+		}
+	} else {
+		for i := sl.maxFiles - 1; i >= 1; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", sl.path, i), fmt.Sprintf("%s.%d", sl.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("rotating slow log: %w", err)
+			}
+		}
+		if err := os.Rename(sl.path, sl.path+".1"); err != nil {
+			return fmt.Errorf("rotating slow log: %w", err)
+		}
+	}
+
+	return sl.open()
+}
+
+// Close closes the log file
+func (sl *SlowLog) Close() error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	sl.closed = true
+	if sl.file == nil {
+		return nil
+	}
+	err := sl.file.Close()
+	sl.file = nil
+	return err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxStackDepth   = 127 // MAX_STACK_DEPTH of monitoring.c
+	maxFoldedStacks = 100 // folded stacks reported per window
+)
+
+// FoldedStack is a user stack sampled while a request was slow, in the folded
+// format of flamegraph.pl: the process name and the frames from the root to the
+// leaf, separated by semicolons
+type FoldedStack struct {
+	Stack   string `json:"stack"`
+	Samples uint64 `json:"samples"`
+}
+
+// String formats the stack as a line of flamegraph.pl input
+func (fs FoldedStack) String() string {
+	return fs.Stack + " " + strconv.FormatUint(fs.Samples, 10)
+}
+
+// foldStack joins the frames of a stack, leaf first as returned by the kernel,
+// into a folded stack rooted at the process name
+func foldStack(comm string, frames []string) string {
+	var folded strings.Builder
+	folded.WriteString(comm)
+	for _, frame := range slices.Backward(frames) {
+		folded.WriteByte(';')
+		folded.WriteString(frame)
+	}
+	return folded.String()
+}
+
+// StackSampler samples the user stacks of nginx workers that have had requests
+// in flight without a break for longer than stack_threshold_ns. A CPU clock perf event on every CPU
+// runs sample_slow_stack, which counts the stacks in the kernel; Collect
+// symbolizes and folds them.
+type StackSampler struct {
+	stacks     *ebpf.Map
+	slowStacks *ebpf.Map
+	events     []int // perf event file descriptors, one per online CPU
+	symbolizer *Symbolizer
+}
+
+// NewStackSampler opens a perf event sampling every CPU at frequency Hz and
+// attaches prog to it
+func NewStackSampler(prog *ebpf.Program, stacks, slowStacks *ebpf.Map, frequency uint64) (*StackSampler, error) {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return nil, fmt.Errorf("counting CPUs: %w", err)
+	}
+
+	ss := &StackSampler{
+		stacks:     stacks,
+		slowStacks: slowStacks,
+		symbolizer: NewSymbolizer(),
+	}
+	for cpu := range cpus {
+		attr := unix.PerfEventAttr{
+			Type:   unix.PERF_TYPE_SOFTWARE,
+			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+			Sample: frequency,
+			Bits:   unix.PerfBitFreq | unix.PerfBitDisabled,
+		}
+		fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+		if errors.Is(err, unix.ENODEV) {
+			continue // possible but offline CPU
+		}
+		if err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("opening perf event on CPU %d: %w", cpu, err)
+		}
+		ss.events = append(ss.events, fd)
+
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog.FD()); err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("attaching stack sampler on CPU %d: %w", cpu, err)
+		}
+		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("enabling perf event on CPU %d: %w", cpu, err)
+		}
+	}
+	return ss, nil
+}
+
+// Collect removes the stacks sampled since the last call from the kernel maps
+// and returns them folded, most sampled first
+func (ss *StackSampler) Collect() ([]FoldedStack, error) {
+	var key trazor_agentStackKey
+	var count uint64
+	counts := make(map[trazor_agentStackKey]uint64)
+
+	iter := ss.slowStacks.Iterate()
+	for iter.Next(&key, &count) {
+		counts[key] = count
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("reading slow stacks: %w", err)
+	}
+
+	// samples counted between the iteration and the deletion are lost, which is
+	// fine for a sampling profiler
+	samples := make(map[string]uint64)
+	mappings := make(map[uint32][]processMapping)
+	comms := make(map[uint32]string)
+	stackIDs := make(map[int32]struct{})
+	var stack [maxStackDepth]uint64
+	for key, count := range counts {
+		ss.slowStacks.Delete(key)
+		stackIDs[key.StackId] = struct{}{}
+
+		if err := ss.stacks.Lookup(uint32(key.StackId), &stack); err != nil {
+			continue // the stack trace map was full when it was sampled
+		}
+		depth := slices.Index(stack[:], 0)
+		if depth < 0 {
+			depth = len(stack)
+		}
+
+		if _, ok := mappings[key.Pid]; !ok {
+			// an exited worker still folds to [unknown] frames under its pid
+			mappings[key.Pid], _ = readExecutableMappings(key.Pid)
+			comms[key.Pid] = readComm(key.Pid)
+		}
+		frames := ss.symbolizer.Frames(key.Pid, mappings[key.Pid], stack[:depth])
+		samples[foldStack(comms[key.Pid], frames)] += count
+	}
+
+	for stackID := range stackIDs {
+		ss.stacks.Delete(uint32(stackID))
+	}
+
+	folded := make([]FoldedStack, 0, len(samples))
+	for stack, count := range samples {
+		folded = append(folded, FoldedStack{Stack: stack, Samples: count})
+	}
+	slices.SortFunc(folded, func(a, b FoldedStack) int {
+		return cmp.Or(cmp.Compare(b.Samples, a.Samples), strings.Compare(a.Stack, b.Stack))
+	})
+	if len(folded) > maxFoldedStacks {
+		folded = folded[:maxFoldedStacks]
+	}
+	return folded, nil
+}
+
+// mergeFoldedStacks adds the samples of stacks to merged and returns the most
+// sampled stacks of both
+func mergeFoldedStacks(merged, stacks []FoldedStack) []FoldedStack {
+	for _, stack := range stacks {
+		i := slices.IndexFunc(merged, func(fs FoldedStack) bool { return fs.Stack == stack.Stack })
+		if i < 0 {
+			merged = append(merged, stack)
+		} else {
+			merged[i].Samples += stack.Samples
+		}
+	}
+	slices.SortStableFunc(merged, func(a, b FoldedStack) int {
+		return cmp.Compare(b.Samples, a.Samples)
+	})
+	if len(merged) > maxFoldedStacks {
+		merged = merged[:maxFoldedStacks]
+	}
+	return merged
+}
+
+// readComm returns the command name of a process, or its pid if it has exited
+func readComm(pid uint32) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return strconv.FormatUint(uint64(pid), 10)
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// Close disables and closes the perf events, detaching the program
+func (ss *StackSampler) Close() error {
+	var errs []error
+	for _, fd := range ss.events {
+		errs = append(errs, unix.Close(fd))
+	}
+	ss.events = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AgentStatus is the JSON document served by the status API
+type AgentStatus struct {
+	AgentID     string             `json:"agent_id"`
+	StartedAt   time.Time          `json:"started_at"`
+	Uptime      string             `json:"uptime"`
+	Connected   bool               `json:"connected"`
+	Attachments []AttachmentStatus `json:"attachments"`
+	ProbeEvents []ProbeEvent       `json:"probe_events"`
+}
+
+// StatusServer exposes the agent's health and probe attachments over HTTP
+type StatusServer struct {
+	server       *http.Server
+	agentID      string
+	startedAt    time.Time
+	probeManager *ProbeManager
+	wsClient     *WebSocketClient
+}
+
+// NewStatusServer creates a new StatusServer listening on addr
+func NewStatusServer(addr, agentID string, probeManager *ProbeManager, wsClient *WebSocketClient) *StatusServer {
+	ss := &StatusServer{
+		agentID:      agentID,
+		startedAt:    time.Now().UTC(),
+		probeManager: probeManager,
+		wsClient:     wsClient,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", ss.handleStatus)
+	ss.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return ss
+}
+
+// Start serves the status API in the background
+func (ss *StatusServer) Start() {
+	go func() {
+		log.Printf("Status API listening on http://%s/status", ss.server.Addr)
+		if err := ss.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Status API error: %v", err)
+		}
+	}()
+}
+
+// Shutdown stops the status API
+func (ss *StatusServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ss.server.Shutdown(ctx)
+}
+
+// handleStatus writes the current AgentStatus as JSON
+func (ss *StatusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := AgentStatus{
+		AgentID:     ss.agentID,
+		StartedAt:   ss.startedAt,
+		Uptime:      time.Since(ss.startedAt).Round(time.Second).String(),
+		Connected:   ss.wsClient.IsConnected(),
+		Attachments: ss.probeManager.Attachments(),
+		ProbeEvents: ss.probeManager.Events(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Writing status: %v", err)
+	}
+}
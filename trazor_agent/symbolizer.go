@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxCachedObjects bounds the number of ELF files whose symbols are kept
+const maxCachedObjects = 256
+
+// symbol is a function of an ELF file
+type symbol struct {
+	addr uint64
+	size uint64 // 0 if unknown
+	name string
+}
+
+// objectSymbols are the functions of one ELF file, sorted by address, and its
+// loadable segments to translate file offsets into virtual addresses
+type objectSymbols struct {
+	symbols []symbol
+	loads   []elf.ProgHeader
+}
+
+// processMapping is an executable file mapping of a process
+type processMapping struct {
+	start, end, offset uint64
+	object             string // device:inode, identifies the file across mount namespaces
+	path               string // path inside the mount namespace of the process
+}
+
+// Symbolizer resolves user-space addresses of processes to function names using
+// the ELF symbol tables of the mapped files, their separate debug files or,
+// for binaries without any symbol table, their DWARF subprograms
+type Symbolizer struct {
+	objects map[string]*objectSymbols // by processMapping.object, nil if unreadable
+}
+
+// NewSymbolizer creates a new Symbolizer
+func NewSymbolizer() *Symbolizer {
+	return &Symbolizer{objects: make(map[string]*objectSymbols)}
+}
+
+// readExecutableMappings returns the executable file mappings of a process
+func readExecutableMappings(pid uint32) ([]processMapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mappings []processMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// start-end perms offset dev inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.Contains(fields[1], "x") || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+
+		startField, endField, _ := strings.Cut(fields[0], "-")
+		start, err1 := strconv.ParseUint(startField, 16, 64)
+		end, err2 := strconv.ParseUint(endField, 16, 64)
+		offset, err3 := strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+
+		mappings = append(mappings, processMapping{
+			start:  start,
+			end:    end,
+			offset: offset,
+			object: fields[3] + ":" + fields[4],
+			path:   fields[5],
+		})
+	}
+	return mappings, scanner.Err()
+}
+
+// Frames returns the function name of every address, in the same order.
+// Addresses outside any mapping are "[unknown]", addresses in a file without a
+// matching symbol are reported as file+offset.
+func (s *Symbolizer) Frames(pid uint32, mappings []processMapping, addrs []uint64) []string {
+	frames := make([]string, len(addrs))
+	for i, addr := range addrs {
+		frames[i] = s.frame(pid, mappings, addr)
+	}
+	return frames
+}
+
+// frame resolves a single address
+func (s *Symbolizer) frame(pid uint32, mappings []processMapping, addr uint64) string {
+	i := slices.IndexFunc(mappings, func(m processMapping) bool { return addr >= m.start && addr < m.end })
+	if i < 0 {
+		return "[unknown]"
+	}
+	mapping := &mappings[i]
+	fileOffset := addr - mapping.start + mapping.offset
+
+	object := s.object(pid, mapping)
+	if object != nil {
+		if name := object.lookup(fileOffset); name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("%s+%#x", filepath.Base(mapping.path), fileOffset)
+}
+
+// object returns the symbols of a mapped file, loading them on first use
+func (s *Symbolizer) object(pid uint32, mapping *processMapping) *objectSymbols {
+	if object, ok := s.objects[mapping.object]; ok {
+		return object
+	}
+	if len(s.objects) >= maxCachedObjects {
+		clear(s.objects)
+	}
+
+	// the file as seen from the mount namespace of the process, e.g. a container
+	object, err := loadObjectSymbols(fmt.Sprintf("/proc/%d/root%s", pid, mapping.path))
+	if err != nil {
+		object = nil
+	}
+	s.objects[mapping.object] = object
+	return object
+}
+
+// loadObjectSymbols reads the function symbols of the ELF file at path
+func loadObjectSymbols(path string) (*objectSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	object := &objectSymbols{}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			object.loads = append(object.loads, prog.ProgHeader)
+		}
+	}
+
+	object.symbols = elfFunctions(f)
+	if len(object.symbols) == 0 {
+		// stripped binary: try the debug file, then DWARF
+		if debugFile, err := openDebugFile(f); err == nil {
+			object.symbols = elfFunctions(debugFile)
+			debugFile.Close()
+		}
+	}
+	if len(object.symbols) == 0 {
+		if data, err := openDWARF(path); err == nil {
+			object.symbols = dwarfFunctions(data)
+		}
+	}
+	if len(object.symbols) == 0 {
+		return nil, fmt.Errorf("%s: no symbols", path)
+	}
+
+	slices.SortFunc(object.symbols, func(a, b symbol) int {
+		return cmp.Compare(a.addr, b.addr)
+	})
+	return object, nil
+}
+
+// openDebugFile opens the separate debug file of f, located by build-id
+func openDebugFile(f *elf.File) (*elf.File, error) {
+	buildID := readBuildID(f)
+	if len(buildID) < 3 {
+		return nil, fmt.Errorf("no build-id")
+	}
+	return elf.Open(filepath.Join(debugFileDir, buildID[:2], buildID[2:]+".debug"))
+}
+
+// elfFunctions returns the functions of the symbol and dynamic symbol tables of f
+func elfFunctions(f *elf.File) []symbol {
+	var functions []symbol
+	for _, read := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+		symbols, err := read()
+		if err != nil {
+			continue
+		}
+		for _, sym := range symbols {
+			if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+				functions = append(functions, symbol{addr: sym.Value, size: sym.Size, name: sym.Name})
+			}
+		}
+	}
+	return functions
+}
+
+// dwarfFunctions returns the functions described by the subprograms of data
+func dwarfFunctions(data *dwarf.Data) []symbol {
+	var functions []symbol
+
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil || entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagSubprogram {
+			continue
+		}
+
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		low, ok := entry.Val(dwarf.AttrLowpc).(uint64)
+		if name == "" || !ok {
+			continue
+		}
+
+		// DW_AT_high_pc is an address, or since DWARF 4 an offset from low_pc
+		var size uint64
+		switch high := entry.Val(dwarf.AttrHighpc).(type) {
+		case uint64:
+			if high > low {
+				size = high - low
+			}
+		case int64:
+			size = uint64(high)
+		}
+		functions = append(functions, symbol{addr: low, size: size, name: name})
+	}
+	return functions
+}
+
+// lookup returns the function containing the file offset, or ""
+func (o *objectSymbols) lookup(fileOffset uint64) string {
+	// a loadable segment maps file offsets to virtual addresses
+	i := slices.IndexFunc(o.loads, func(p elf.ProgHeader) bool {
+		return fileOffset >= p.Off && fileOffset < p.Off+p.Filesz
+	})
+	if i < 0 {
+		return ""
+	}
+	addr := fileOffset - o.loads[i].Off + o.loads[i].Vaddr
+
+	// the last symbol starting at or before addr
+	j, found := slices.BinarySearchFunc(o.symbols, addr, func(s symbol, addr uint64) int {
+		return cmp.Compare(s.addr, addr)
+	})
+	if !found {
+		j--
+	}
+	if j < 0 {
+		return ""
+	}
+	sym := o.symbols[j]
+	if sym.size > 0 && addr >= sym.addr+sym.size {
+		return ""
+	}
+	return sym.name
+}
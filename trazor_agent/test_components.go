@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"debug/elf"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -71,7 +85,7 @@ func testPercentileCalculation() {
 
 	// Test multiple percentiles at once
 	percentiles := []float64{50, 95, 99}
-	results := CalculateMultiplePercentiles(latencies, percentiles)
+	results := CalculateMultiplePercentiles(latencies, percentiles, NearestRank)
 
 	fmt.Printf("Multiple calculation results:\n")
 	for _, p := range percentiles {
@@ -112,12 +126,1299 @@ func testWindowAggregator() {
 	fmt.Printf("=================================\n")
 }
 
+// Test parsing of trace mode targets
+func testTraceTargets() {
+	fmt.Printf("=== Testing Trace Targets ===\n")
+
+	for _, spec := range []string{"/usr/lib/libssl.so.3:SSL_read", "./server:handle_request", "nosymbol:", "missing"} {
+		target, err := ParseTraceTarget(spec)
+		if err != nil {
+			fmt.Printf("  %q -> error: %v\n", spec, err)
+			continue
+		}
+		fmt.Printf("  %q -> binary=%s symbol=%s series=%s\n", spec, target.Binary, target.Symbol, target.Label())
+	}
+	fmt.Printf("=============================\n")
+}
+
+// Test Go probe offset resolution against the agent's own binary, which links net/http
+func testGoProbeOffsets() {
+	fmt.Printf("=== Testing Go Probe Offsets ===\n")
+
+	for _, version := range []string{"go1.22.5", "go1.23.0", "go1.25.1", "go1.26.0", "go1.20"} {
+		offsets, err := defaultGoOffsets(version)
+		fmt.Printf("  defaults %s: goid=%d err=%v\n", version, offsets.Goid, err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("Locating executable: %v", err)
+		return
+	}
+	f, err := elf.Open(self)
+	if err != nil {
+		log.Printf("Opening executable: %v", err)
+		return
+	}
+	defer f.Close()
+
+	offsets, err := resolveGoOffsets(f)
+	fmt.Printf("  DWARF: goid=%d request.URL=%d url.Path=%d err=%v\n",
+		offsets.Goid, offsets.RequestUrl, offsets.UrlPath, err)
+
+	returns, err := findReturnOffsets(f, goServeHTTPSymbol)
+	fmt.Printf("  %s return offsets: %v err=%v\n", goServeHTTPSymbol, returns, err)
+	fmt.Printf("================================\n")
+}
+
+// Test the upstream versus nginx-internal latency split
+func testUpstreamSplit() {
+	fmt.Printf("=== Testing Upstream Split ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	backend := UpstreamAddr{Family: afInet, Port: 8080}
+	copy(backend.IP[:], []byte{10, 0, 0, 7})
+
+	for i := 0; i < 10; i++ {
+		// proxied: 100μs in nginx plus (i+1)ms in the upstream
+		upstreamNs := uint64((i + 1) * 1000000)
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID:  1234,
+			LatencyNs:  upstreamNs + 100000,
+			TTFBNs:     upstreamNs + 60000,
+			Timestamp:  time.Now().UnixNano(),
+			UpstreamNs: upstreamNs,
+			Upstream:   backend,
+		})
+		// served locally in 50μs
+		aggregator.AddSample(1234, 50000, time.Now().UnixNano())
+	}
+
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		fmt.Printf("  Total Requests: %d, Upstream Requests: %d (expected 10)\n", metrics.TotalRequests, metrics.UpstreamRequests)
+		fmt.Printf("  Upstream P50: %d μs (expected ~5000), nginx P99: %d μs (expected 100)\n",
+			metrics.UpstreamP50Latency, metrics.NginxP99Latency)
+		fmt.Printf("  TTFB P50: %d μs (expected ~5060)\n", metrics.TTFBP50Latency)
+		for addr, upstream := range metrics.UpstreamBreakdown {
+			fmt.Printf("  Upstream %s: %d requests, P95=%d μs\n", addr, upstream.Requests, upstream.P95Latency)
+		}
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+	fmt.Printf("==============================\n")
+}
+
+// Test two requests interleaved on one worker: A is proxied, B is served
+// locally while A waits for its upstream, so B finishes first. The upstream
+// state is kept per request, so only A carries upstream time.
+func testInterleavedRequests() {
+	fmt.Printf("=== Testing Interleaved Requests ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	backend := UpstreamAddr{Family: afInet, Port: 8080}
+	copy(backend.IP[:], []byte{10, 0, 0, 7})
+
+	local := HttpEvent{LatencyNs: 300000, ProcessId: 1234, SampleRate: 1, Status: 200}
+	proxied := HttpEvent{
+		LatencyNs:      20500000,
+		UpstreamNs:     20000000,
+		ProcessId:      1234,
+		SampleRate:     1,
+		Status:         200,
+		UpstreamFamily: backend.Family,
+		UpstreamPort:   backend.Port,
+		UpstreamAddr:   backend.IP,
+	}
+	for _, event := range []HttpEvent{local, proxied} {
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID:  event.ProcessId,
+			LatencyNs:  event.LatencyNs,
+			Timestamp:  time.Now().UnixNano(),
+			UpstreamNs: event.UpstreamNs,
+			Status:     event.Status,
+			SampleRate: event.SampleRate,
+			Upstream: UpstreamAddr{
+				Family: event.UpstreamFamily,
+				Port:   event.UpstreamPort,
+				IP:     event.UpstreamAddr,
+			},
+		})
+	}
+
+	aggregator.RotateWindow()
+	metrics := <-metricsChannel
+	fmt.Printf("  Requests: %d, Upstream Requests: %d (expected 2, 1)\n", metrics.TotalRequests, metrics.UpstreamRequests)
+	fmt.Printf("  Upstream P50: %d μs (expected 20000)\n", metrics.UpstreamP50Latency)
+	for addr, upstream := range metrics.UpstreamBreakdown {
+		fmt.Printf("  Upstream %s: %d requests (expected 1)\n", addr, upstream.Requests)
+	}
+	fmt.Printf("==============================\n")
+}
+
+func testSizeMetrics() {
+	fmt.Printf("=== Testing Size Metrics ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	for i := 0; i < 10; i++ {
+		// small responses are fast, 5MiB downloads are slow
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID:    1234,
+			LatencyNs:    200000,
+			Timestamp:    time.Now().UnixNano(),
+			RequestBytes: 100,
+			BytesSent:    512,
+			SizesKnown:   true,
+		})
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID:  1234,
+			LatencyNs:  50000000,
+			Timestamp:  time.Now().UnixNano(),
+			BytesSent:  5 << 20,
+			SizesKnown: true,
+		})
+		// e.g. a Go request, or nginx without DWARF offsets: sizes unknown
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID: 4321,
+			LatencyNs: 1000000,
+			Timestamp: time.Now().UnixNano(),
+		})
+	}
+
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		fmt.Printf("  Request Bytes: %d (expected 1000), Response Bytes: %d (expected %d)\n",
+			metrics.RequestBytes, metrics.ResponseBytes, 10*512+10*(5<<20))
+		fmt.Printf("  Response Throughput: %.0f B/s over 1s\n", metrics.ResponseThroughput)
+		fmt.Printf("  Response Size P50: %d, P99: %d (expected 512, %d)\n",
+			metrics.ResponseSizeP50, metrics.ResponseSizeP99, 5<<20)
+		for _, bucket := range metrics.LatencyByResponseSize {
+			fmt.Printf("  Bucket %s: %d requests, P50=%d μs\n", bucket.Bucket, bucket.Requests, bucket.P50Latency)
+		}
+		fmt.Printf("  Size Buckets: %d (expected 2: <=1KiB at 200μs, <=10MiB at 50000μs)\n",
+			len(metrics.LatencyByResponseSize))
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+
+	aggregator.AddSample(4321, 1000000, time.Now().UnixNano())
+	aggregator.RotateWindow()
+	metrics := <-metricsChannel
+	fmt.Printf("  Without sizes: response P50 %d, buckets %d (expected 0, 0)\n",
+		metrics.ResponseSizeP50, len(metrics.LatencyByResponseSize))
+	fmt.Printf("==============================\n")
+}
+
+func testStatusMetrics() {
+	fmt.Printf("=== Testing Status Metrics ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	for i := 0; i < 10; i++ {
+		// 200s take 1-10ms, 502s fail fast in 10μs
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID: 1234,
+			LatencyNs: uint64((i + 1) * 1000000),
+			Timestamp: time.Now().UnixNano(),
+			Status:    200,
+		})
+		if i%2 == 0 {
+			aggregator.AddLatencySample(LatencySample{
+				ProcessID: 1234,
+				LatencyNs: 10000,
+				Timestamp: time.Now().UnixNano(),
+				Status:    502,
+			})
+		}
+	}
+	aggregator.AddLatencySample(LatencySample{ProcessID: 1234, LatencyNs: 20000, Status: 404})
+	// unknown status is not counted
+	aggregator.AddSample(1234, 30000, time.Now().UnixNano())
+
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		fmt.Printf("  Status Classes: %v (expected 2xx:10 4xx:1 5xx:5)\n", metrics.StatusClasses)
+		fmt.Printf("  Status Codes: %v\n", metrics.StatusCodes)
+		fmt.Printf("  Errors: %d, Ratio: %.3f (expected 5, 0.312)\n", metrics.ErrorRequests, metrics.ErrorRatio)
+		fmt.Printf("  Success P50: %d μs (expected 5000), Error P99: %d μs (expected 10)\n",
+			metrics.SuccessP50Latency, metrics.ErrorP99Latency)
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+	fmt.Printf("==============================\n")
+}
+
+func testSampledMetrics() {
+	fmt.Printf("=== Testing Sampled Metrics ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	// 1-in-10 sampling: 50 events stand for ~500 requests
+	for i := 0; i < 50; i++ {
+		aggregator.AddLatencySample(LatencySample{
+			ProcessID:  1234 + uint32(i%2),
+			LatencyNs:  uint64((i + 1) * 10000),
+			Timestamp:  time.Now().UnixNano(),
+			BytesSent:  100,
+			SizesKnown: true,
+			Status:     200,
+			SampleRate: 10,
+		})
+	}
+	aggregator.SetKernelCounts(497, 3)
+
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		fmt.Printf("  Total Requests: %d (expected 500), Sampled: %d (expected 50), Exact: %d (expected 497), Dropped: %d (expected 3)\n",
+			metrics.TotalRequests, metrics.SampledRequests, metrics.ExactRequests, metrics.DroppedEvents)
+		fmt.Printf("  Sample Rate: %.1f (expected 10.0), Process Breakdown: %v (expected 250 each)\n",
+			metrics.SampleRate, metrics.ProcessBreakdown)
+		fmt.Printf("  Response Bytes: %d (expected 50000), 2xx: %d (expected 500)\n",
+			metrics.ResponseBytes, metrics.StatusClasses["2xx"])
+		fmt.Printf("  Avg: %.2f μs (expected 255.00), P50: %d μs (expected 250)\n",
+			metrics.AvgLatency, metrics.P50Latency)
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+	fmt.Printf("==============================\n")
+}
+
+// Test a window whose sampling rate changed: its percentiles are those of the
+// requests the samples stand for, not of the samples
+func testMixedRateWindow() {
+	fmt.Printf("=== Testing Mixed-Rate Window ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	// 90 fast requests before the rate went up to 10, then 10 slow samples
+	for i := range 100 {
+		sample := LatencySample{ProcessID: 1234, LatencyNs: 1000000, Timestamp: time.Now().UnixNano(), Status: 200, SampleRate: 1}
+		if i >= 90 {
+			sample.LatencyNs = 100000000
+			sample.TTFBNs = 90000000
+			sample.SampleRate = 10
+		} else {
+			sample.TTFBNs = 500000
+		}
+		aggregator.AddLatencySample(sample)
+	}
+	aggregator.RotateWindow()
+	metrics := <-metricsChannel
+	fmt.Printf("  Total Requests: %d (expected 190), Sampled: %d (expected 100)\n", metrics.TotalRequests, metrics.SampledRequests)
+	fmt.Printf("  P50: %d μs (expected 100000), P95: %d μs (expected 100000), Avg: %.0f μs (expected 53105)\n",
+		metrics.P50Latency, metrics.P95Latency, metrics.AvgLatency)
+	fmt.Printf("  TTFB P50: %d μs (expected 90000), Success P50: %d μs (expected 100000)\n",
+		metrics.TTFBP50Latency, metrics.SuccessP50Latency)
+
+	// weighted percentiles equal those of the sample with every value repeated
+	rng := rand.New(rand.NewPCG(7, 8))
+	mismatches := 0
+	for _, method := range []PercentileMethod{NearestRank, LinearInterpolation, HyndmanFanType7} {
+		for range 20 {
+			var values weightedValues
+			var repeated []uint64
+			for range 1 + rng.IntN(50) {
+				value, weight := rng.Uint64N(1000), 1+rng.Uint64N(8)
+				values.add(value, weight)
+				for range weight {
+					repeated = append(repeated, value)
+				}
+			}
+			percentiles := []float64{1, 50, 90, 99, 99.9}
+			if !maps.Equal(values.percentiles(percentiles, method), CalculateMultiplePercentiles(repeated, percentiles, method)) {
+				mismatches++
+			}
+		}
+	}
+	fmt.Printf("  Weighted versus repeated samples: %d mismatches (expected 0)\n", mismatches)
+	fmt.Printf("==============================\n")
+}
+
+func testAdaptiveSampleRate() {
+	fmt.Printf("=== Testing Adaptive Sample Rate ===\n")
+
+	cases := []struct {
+		current     uint32
+		requestRate float64
+		dropped     bool
+		expected    uint32
+	}{
+		{1, 2000, false, 1},    // within budget
+		{1, 120000, false, 24}, // 120k req/s over a 5k budget
+		{24, 1000, false, 12},  // traffic dropped, lowered by at most half
+		{4, 10000, true, 8},    // drops double the rate
+		{600, 1e7, false, 1000},
+	}
+
+	for _, c := range cases {
+		rate := nextSampleRate(c.current, c.requestRate, 5000, c.dropped, 1000)
+		fmt.Printf("  current 1/%d, %.0f req/s, dropped=%v -> 1/%d (expected 1/%d)\n",
+			c.current, c.requestRate, c.dropped, rate, c.expected)
+	}
+
+	rate := nextSampleRate(1<<31, 0, 5000, true, math.MaxUint32)
+	fmt.Printf("  current 1/%d with drops, no limit -> 1/%d (expected 1/%d)\n", uint32(1<<31), rate, uint32(math.MaxUint32))
+	fmt.Printf("==============================\n")
+}
+
+// sampleHttpEventRecord returns a raw struct http_event as found in a ringbuf record
+func sampleHttpEventRecord() []byte {
+	event := HttpEvent{
+		Timestamp:      1700000000000000000,
+		LatencyNs:      1500000,
+		TTFBNs:         900000,
+		UpstreamNs:     1200000,
+		RequestBytes:   512,
+		BytesSent:      16384,
+		SizesKnown:     1,
+		CPUNs:          200000,
+		RunQueueNs:     50000,
+		BlockedNs:      1250000,
+		ProcessId:      4242,
+		SampleRate:     4,
+		Status:         200,
+		UpstreamFamily: afInet,
+		UpstreamPort:   8080,
+	}
+	copy(event.UpstreamAddr[:], []byte{10, 0, 0, 7})
+	copy(event.Path[:], "/api/v1/items")
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &event)
+	// the kernel pads the struct to its 8 byte alignment
+	buf.Write(make([]byte, 1))
+	return buf.Bytes()
+}
+
+// latencyDistributions generates n latencies in nanoseconds for the percentile benchmarks
+var latencyDistributions = []struct {
+	name     string
+	generate func(rng *rand.Rand, n int) []uint64
+}{
+	{"uniform", func(rng *rand.Rand, n int) []uint64 {
+		return generateLatencies(n, func() uint64 { return 1000 + rng.Uint64N(10000000) })
+	}},
+	// cached responses all taking 12μs
+	{"constant", func(rng *rand.Rand, n int) []uint64 {
+		return generateLatencies(n, func() uint64 { return 12000 })
+	}},
+	// 90% cache hits at 12μs, 10% upstream fetches around 5ms
+	{"bimodal", func(rng *rand.Rand, n int) []uint64 {
+		return generateLatencies(n, func() uint64 {
+			if rng.IntN(10) > 0 {
+				return 12000
+			}
+			return 5000000 + rng.Uint64N(1000000)
+		})
+	}},
+	// log-normal body with a long tail, rounded to μs like timer-bound latencies
+	{"heavy-tailed", func(rng *rand.Rand, n int) []uint64 {
+		return generateLatencies(n, func() uint64 {
+			return uint64(math.Exp(11+1.5*rng.NormFloat64())/1000) * 1000
+		})
+	}},
+	// already sorted input, as produced by a steady ramp of load
+	{"sorted", func(rng *rand.Rand, n int) []uint64 {
+		i := uint64(0)
+		return generateLatencies(n, func() uint64 { i++; return i * 1000 })
+	}},
+}
+
+// generateLatencies returns n values of next
+func generateLatencies(n int, next func() uint64) []uint64 {
+	latencies := make([]uint64, n)
+	for i := range latencies {
+		latencies[i] = next()
+	}
+	return latencies
+}
+
+// allocsPerRun returns the average number of heap allocations of f over runs
+// calls, like testing.AllocsPerRun without linking the testing package
+func allocsPerRun(runs int, f func()) float64 {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	f() // warm up
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for range runs {
+		f()
+	}
+	runtime.ReadMemStats(&after)
+	return float64((after.Mallocs - before.Mallocs) / uint64(runs))
+}
+
+func testEventDecoding() {
+	fmt.Printf("=== Testing Event Decoding ===\n")
+
+	raw := sampleHttpEventRecord()
+
+	var expected, decoded HttpEvent
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &expected); err != nil {
+		log.Printf("binary.Read: %v", err)
+		return
+	}
+	if err := decoded.Decode(raw); err != nil {
+		log.Printf("Decode: %v", err)
+		return
+	}
+	fmt.Printf("  Decode matches binary.Read: %v (expected true)\n", decoded == expected)
+	fmt.Printf("  Path: %s, Status: %d, Sample Rate: %d\n", decoded.PathString(), decoded.Status, decoded.SampleRate)
+	fmt.Printf("  Scheduler: cpu=%dns, run queue=%dns, blocked=%dns (expected 200000, 50000, 1250000)\n",
+		decoded.CPUNs, decoded.RunQueueNs, decoded.BlockedNs)
+	fmt.Printf("  Short record: %v (expected error)\n", decoded.Decode(raw[:httpEventSize-1]))
+
+	allocs := allocsPerRun(100, func() { decoded.Decode(raw) })
+	fmt.Printf("  Allocations per decode: %.0f (expected 0)\n", allocs)
+	fmt.Printf("==============================\n")
+}
+
+func testConcurrentIngestion() {
+	fmt.Printf("=== Testing Concurrent Ingestion ===\n")
+
+	metricsChannel := make(chan *WindowMetrics, 100)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	// several ringbuf consumers keep adding samples while windows rotate
+	const consumers, perConsumer = 4, 2500
+	var wg sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		wg.Go(func() {
+			for i := 0; i < perConsumer; i++ {
+				aggregator.AddSample(uint32(1000+c*7+i%3), uint64(i+1)*1000, time.Now().UnixNano())
+			}
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	rotations := 0
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+			aggregator.RotateWindow()
+			rotations++
+		}
+	}
+	aggregator.RotateWindow()
+
+	var total uint64
+	windows := 0
+	for len(metricsChannel) > 0 {
+		metrics := <-metricsChannel
+		total += metrics.TotalRequests
+		windows++
+	}
+	fmt.Printf("  Rotations: %d, windows emitted: %d\n", rotations+1, windows)
+	fmt.Printf("  Requests across windows: %d (expected %d)\n", total, consumers*perConsumer)
+	fmt.Printf("==============================\n")
+}
+
+func testQuickSelect() {
+	fmt.Printf("=== Testing Quickselect ===\n")
+
+	rng := rand.New(rand.NewPCG(3, 4))
+	mismatches, checked := 0, 0
+	for _, dist := range latencyDistributions {
+		for _, n := range []int{1, 2, 3, 17, 1001, 5000} {
+			latencies := dist.generate(rng, n)
+			sorted := slices.Clone(latencies)
+			slices.Sort(sorted)
+
+			for _, k := range []int{0, n / 2, n * 95 / 100, n * 99 / 100, n - 1} {
+				checked++
+				if got := quickSelect(slices.Clone(latencies), k); got != sorted[k] {
+					mismatches++
+					fmt.Printf("  %s n=%d k=%d: got %d, expected %d\n", dist.name, n, k, got, sorted[k])
+				}
+			}
+		}
+	}
+	fmt.Printf("  Order statistics checked: %d, mismatches: %d (expected 0)\n", checked, mismatches)
+
+	// multiSelect resolves several order statistics in one pass
+	mismatches, checked = 0, 0
+	for _, dist := range latencyDistributions {
+		for _, n := range []int{1, 5, 1001, 20000} {
+			latencies := dist.generate(rng, n)
+			sorted := slices.Clone(latencies)
+			slices.Sort(sorted)
+
+			ks := []int{0, n / 10, n / 2, n * 9 / 10, n * 99 / 100, n * 999 / 1000, n - 1}
+			slices.Sort(ks)
+			ks = slices.Compact(ks)
+			data := slices.Clone(latencies)
+			multiSelect(data, ks)
+			for _, k := range ks {
+				checked++
+				if data[k] != sorted[k] {
+					mismatches++
+					fmt.Printf("  multiSelect %s n=%d k=%d: got %d, expected %d\n", dist.name, n, k, data[k], sorted[k])
+				}
+			}
+		}
+	}
+	fmt.Printf("  Multi-select order statistics checked: %d, mismatches: %d (expected 0)\n", checked, mismatches)
+
+	batch := CalculateMultiplePercentiles(latencyDistributions[3].generate(rng, 50000), []float64{99, 50, 95, 50}, NearestRank)
+	fmt.Printf("  Batch percentiles (unsorted, duplicate request): %v\n", batch)
+
+	// a constant window used to take quadratic time
+	start := time.Now()
+	constant := make([]uint64, 200000)
+	for i := range constant {
+		constant[i] = 12000
+	}
+	p99 := CalculatePercentile(constant, 99)
+	fmt.Printf("  Constant window of %d: P99=%d in %v\n", len(constant), p99, time.Since(start).Round(time.Millisecond))
+	fmt.Printf("==============================\n")
+}
+
+func testPercentileMethods() {
+	fmt.Printf("=== Testing Percentile Methods ===\n")
+
+	// reference values from R's quantile(x, p, type = 1, 4 and 7)
+	tenValues := []uint64{1000, 2000, 3000, 4000, 5000, 6000, 7000, 8000, 9000, 10000}
+	fiveValues := []uint64{50, 15, 40, 20, 35} // unsorted on purpose
+	references := []struct {
+		name       string
+		values     []uint64
+		method     PercentileMethod
+		percentile float64
+		expected   uint64
+	}{
+		{"1..10k", tenValues, NearestRank, 50, 5000},
+		{"1..10k", tenValues, NearestRank, 90, 9000},
+		{"1..10k", tenValues, NearestRank, 99, 10000},
+		{"1..10k", tenValues, LinearInterpolation, 50, 5000},
+		{"1..10k", tenValues, LinearInterpolation, 95, 9500},
+		{"1..10k", tenValues, LinearInterpolation, 99, 9900},
+		{"1..10k", tenValues, HyndmanFanType7, 50, 5500},
+		{"1..10k", tenValues, HyndmanFanType7, 90, 9100},
+		{"1..10k", tenValues, HyndmanFanType7, 95, 9550},
+		{"1..10k", tenValues, HyndmanFanType7, 99, 9910},
+		{"wikipedia", fiveValues, NearestRank, 5, 15},
+		{"wikipedia", fiveValues, NearestRank, 30, 20},
+		{"wikipedia", fiveValues, NearestRank, 40, 20},
+		{"wikipedia", fiveValues, NearestRank, 50, 35},
+		{"wikipedia", fiveValues, NearestRank, 100, 50},
+		{"wikipedia", fiveValues, LinearInterpolation, 40, 20},
+		{"wikipedia", fiveValues, LinearInterpolation, 75, 39}, // 38.75
+		{"wikipedia", fiveValues, HyndmanFanType7, 40, 29},
+		{"wikipedia", fiveValues, HyndmanFanType7, 75, 40},
+	}
+
+	failures := 0
+	for _, ref := range references {
+		got := CalculateMultiplePercentiles(ref.values, []float64{ref.percentile}, ref.method)[ref.percentile]
+		if got != ref.expected {
+			failures++
+			fmt.Printf("  %s %s p%g: got %d, expected %d\n", ref.name, ref.method, ref.percentile, got, ref.expected)
+		}
+	}
+	fmt.Printf("  Reference values checked: %d, failures: %d (expected 0)\n", len(references), failures)
+
+	// the selection path for large windows must agree with the sorted path
+	large := make([]uint64, 2000)
+	for i := range large {
+		large[len(large)-1-i] = uint64(i+1) * 1000
+	}
+	for _, method := range []PercentileMethod{NearestRank, LinearInterpolation, HyndmanFanType7} {
+		result := CalculateMultiplePercentiles(large, []float64{50, 99.9, 99.99}, method)
+		fmt.Printf("  n=2000 %-12s p50=%d p99.9=%d p99.99=%d\n", method, result[50], result[99.9], result[99.99])
+	}
+	fmt.Printf("  (expected nearest-rank 1000000/1998000/2000000, linear 1000000/1998000/1999800, type7 1000500/1998001/1999800)\n")
+
+	// configured percentiles end up in WindowMetrics.Percentiles
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	percentiles, err := ParsePercentiles("90, 99.9,99.99")
+	if err != nil {
+		log.Printf("ParsePercentiles: %v", err)
+		return
+	}
+	aggregator.SetPercentiles(percentiles, HyndmanFanType7)
+	for _, latency := range large {
+		aggregator.AddSample(1234, latency, time.Now().UnixNano())
+	}
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		fmt.Printf("  Percentiles (%s): %v\n", metrics.PercentileMethod, metrics.Percentiles)
+		fmt.Printf("  (expected p90:1800 p99.9:1998 p99.99:1999)\n")
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+
+	_, err = ParsePercentiles("99,abc")
+	fmt.Printf("  Invalid list: %v (expected error)\n", err)
+	fmt.Printf("==============================\n")
+}
+
+func testLatencyHistogram() {
+	fmt.Printf("Testing latency histogram...\n")
+
+	for _, spec := range []string{"prometheus", "explicit:100,250,500", "exponential:1,1.5,6", "log-linear:100,1000,4"} {
+		layout, err := ParseHistogramLayout(spec)
+		if err != nil {
+			log.Printf("ParseHistogramLayout(%q): %v", spec, err)
+			return
+		}
+		fmt.Printf("  %-22s %v\n", spec, layout.Bounds())
+	}
+	fmt.Printf("  (expected exponential 1 2 3 4 5 8, log-linear 100 125 150 175 200 250 300 350 400 500 600 700 800 1000)\n")
+
+	for _, spec := range []string{"explicit:500,100", "exponential:100,1,4", "linear:1,2"} {
+		_, err := ParseHistogramLayout(spec)
+		fmt.Printf("  %s: %v (expected error)\n", spec, err)
+	}
+
+	// bounds are inclusive, sampled requests count with their weight
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	layout, _ := ExplicitLayout([]uint64{100, 250, 500})
+	aggregator.SetHistogramLayout(layout)
+
+	now := time.Now().UnixNano()
+	for _, latencyUs := range []uint64{50, 100, 101, 250, 300, 499, 10000} {
+		aggregator.AddLatencySample(LatencySample{ProcessID: 1234, LatencyNs: latencyUs * 1000, Timestamp: now, SampleRate: 1})
+	}
+	aggregator.AddLatencySample(LatencySample{ProcessID: 1234, LatencyNs: 5_000_000, Timestamp: now, SampleRate: 10})
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		histogram := metrics.LatencyHistogram
+		fmt.Printf("  Counts %v of bounds %v, total %d of %d requests\n",
+			histogram.Counts, histogram.Bounds, histogram.Total(), metrics.TotalRequests)
+		fmt.Printf("  (expected counts [2 2 2 11], total 17 of 17)\n")
+
+		merged := NewLatencyHistogram(layout)
+		merged.Merge(histogram)
+		merged.Merge(histogram)
+		fmt.Printf("  Merged twice: %v (expected [4 4 4 22])\n", merged.Counts)
+
+		other, _ := ExponentialLayout(100, 2, 3)
+		fmt.Printf("  Merge with other layout: %v (expected error)\n", merged.Merge(NewLatencyHistogram(other)))
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+	fmt.Printf("==============================\n")
+}
+
+func testRollups() {
+	fmt.Printf("Testing latency sketch and rollups...\n")
+
+	// six windows of heavy-tailed latencies, sketched separately and merged
+	rng := rand.New(rand.NewPCG(3, 4))
+	merged := NewLatencySketch()
+	var all []uint64
+	for range 6 {
+		sketch := NewLatencySketch()
+		for range 5000 {
+			latency := uint64(50_000 + rng.ExpFloat64()*200_000)
+			if rng.IntN(100) == 0 {
+				latency *= 20
+			}
+			sketch.Add(latency, 1)
+			all = append(all, latency)
+		}
+		merged.Merge(sketch)
+	}
+
+	percentiles := []float64{50, 90, 99, 99.9}
+	estimated := merged.Quantiles(percentiles)
+	exact := CalculateMultiplePercentiles(all, percentiles, NearestRank)
+	worst := 0.0
+	for _, percentile := range percentiles {
+		relativeError := math.Abs(float64(estimated[percentile])-float64(exact[percentile])) / float64(exact[percentile])
+		worst = max(worst, relativeError)
+		fmt.Printf("  p%v: sketch %d, exact %d\n", percentile, estimated[percentile], exact[percentile])
+	}
+	fmt.Printf("  Merged count %d, worst relative error %.4f (expected 30000, <= %.2f)\n", merged.Count(), worst, sketchAccuracy)
+
+	resolutions, err := ParseRollups("20s, 40s", 10*time.Second)
+	fmt.Printf("  ParseRollups: %v %v\n", resolutions, err)
+	_, err = ParseRollups("1m,90s", 10*time.Second)
+	fmt.Printf("  ParseRollups(1m,90s): %v (expected error)\n", err)
+	fmt.Printf("  Resolutions: %s %s %s %s (expected 10s 1m 5m 1h)\n", formatResolution(10*time.Second),
+		formatResolution(time.Minute), formatResolution(5*time.Minute), formatResolution(time.Hour))
+
+	// 1s windows rolled up into 2s and 4s; the third window has no traffic
+	metricsChannel := make(chan *WindowMetrics, 20)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	aggregator.SetRollups([]time.Duration{2 * time.Second, 4 * time.Second})
+	aggregator.windowStart = time.Now().UnixNano() / int64(4*time.Second) * int64(4*time.Second)
+	start := aggregator.windowStart
+
+	backend := UpstreamAddr{Family: afInet, Port: 8080}
+	copy(backend.IP[:], []byte{10, 0, 0, 7})
+
+	for window := range 4 {
+		if window != 2 {
+			for i := range 100 {
+				latency := uint64(window*100+i+1) * 1000
+				aggregator.AddLatencySample(LatencySample{
+					ProcessID:  uint32(1000 + window),
+					LatencyNs:  latency,
+					TTFBNs:     latency / 2,
+					UpstreamNs: latency / 4,
+					Upstream:   backend,
+					Timestamp:  start,
+					Status:     uint16(200 + 300*(i%10/9)),
+					BytesSent:  100,
+					SizesKnown: true,
+					SampleRate: uint32(window + 1),
+				})
+			}
+		}
+		aggregator.RotateWindow()
+	}
+
+	close(metricsChannel)
+	for metrics := range metricsChannel {
+		fmt.Printf("  %-3s +%ds..+%ds: total %d, sampled %d, P50 %d, P99 %d, max %d, errors %.2f, pids %d\n",
+			metrics.Resolution, (metrics.WindowStart-start)/int64(time.Second), (metrics.WindowEnd-start)/int64(time.Second),
+			metrics.TotalRequests, metrics.SampledRequests, metrics.P50Latency, metrics.P99Latency,
+			metrics.MaxLatency, metrics.ErrorRatio, len(metrics.ProcessBreakdown))
+		upstream := metrics.UpstreamBreakdown[backend.String()]
+		fmt.Printf("      TTFB P50 %d, upstream P50 %d (%d requests), error P50 %d, response P50 %d, size buckets %d\n",
+			metrics.TTFBP50Latency, metrics.UpstreamP50Latency, upstream.Requests, metrics.ErrorP50Latency,
+			metrics.ResponseSizeP50, len(metrics.LatencyByResponseSize))
+	}
+	fmt.Printf("  (expected 1s windows at +0 +1 +3, 2s rollups of 300 and 400 requests, one 4s rollup of 700 requests;\n")
+	fmt.Printf("   TTFB and upstream P50 about half and a quarter of P50, all requests upstream, response P50 100, 1 bucket)\n")
+	fmt.Printf("==============================\n")
+}
+
+func testHoppingWindows() {
+	fmt.Printf("Testing hopping windows...\n")
+
+	configs, err := ParseHoppingWindows("3s,4s/2s", time.Second)
+	fmt.Printf("  ParseHoppingWindows: %v %v\n", configs, err)
+	for _, list := range []string{"1s", "3s/1500ms", "1m/2m"} {
+		_, err := ParseHoppingWindows(list, time.Second)
+		fmt.Printf("  %s: %v (expected error)\n", list, err)
+	}
+
+	// 1s sub-windows; the fourth one has no traffic
+	metricsChannel := make(chan *WindowMetrics, 20)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	aggregator.SetHoppingWindows(configs)
+	aggregator.windowStart = time.Now().UnixNano() / int64(4*time.Second) * int64(4*time.Second)
+	start := aggregator.windowStart
+
+	for window := range 5 {
+		if window != 3 {
+			for i := range 100 {
+				aggregator.AddLatencySample(LatencySample{
+					ProcessID:  1234,
+					LatencyNs:  uint64(window*100+i+1) * 1000,
+					Timestamp:  start,
+					BytesSent:  100,
+					SizesKnown: true,
+				})
+			}
+		}
+		aggregator.RotateWindow()
+	}
+
+	close(metricsChannel)
+	for metrics := range metricsChannel {
+		if metrics.Hop == "" {
+			continue
+		}
+		fmt.Printf("  %s every %s, +%ds..+%ds: total %d, min %d, P50 %d, max %d, %.0f B/s\n",
+			metrics.Resolution, metrics.Hop,
+			(metrics.WindowStart-start)/int64(time.Second), (metrics.WindowEnd-start)/int64(time.Second),
+			metrics.TotalRequests, metrics.MinLatency, metrics.P50Latency, metrics.MaxLatency,
+			metrics.ResponseThroughput)
+	}
+	fmt.Printf("  (expected 3s windows +0..+1, +0..+2, +0..+3, +1..+4, +2..+5 with 100, 200, 300, 200, 200\n")
+	fmt.Printf("   requests at 10000, 10000, 10000, 6667, 6667 B/s,\n")
+	fmt.Printf("   4s windows +0..+2 and +0..+4 with 200 and 300 requests at 10000 and 7500 B/s)\n")
+	fmt.Printf("==============================\n")
+}
+
+func testHeartbeat() {
+	fmt.Printf("Testing heartbeat windows...\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+
+	// without heartbeats an idle window is not emitted
+	aggregator.RotateWindow()
+	fmt.Printf("  Idle window without heartbeat: %d emitted (expected 0)\n", len(metricsChannel))
+
+	aggregator.SetHeartbeat(NewHealthMonitor(nil, func() int { return 3 }))
+	aggregator.SetKernelCounts(0, 5)
+	aggregator.RotateWindow()
+
+	select {
+	case metrics := <-metricsChannel:
+		data, err := json.Marshal(metrics)
+		if err != nil {
+			log.Printf("Marshaling heartbeat: %v", err)
+			return
+		}
+		fmt.Printf("  Idle window: total %d, dropped %d, resolution %s, probes %d, goroutines > 0: %v\n",
+			metrics.TotalRequests, metrics.DroppedEvents, metrics.Resolution,
+			metrics.Health.AttachedProbes, metrics.Health.Goroutines > 0)
+		fmt.Printf("  JSON has total_requests 0 and agent_health: %v\n",
+			bytes.Contains(data, []byte(`"total_requests":0`)) && bytes.Contains(data, []byte(`"agent_health":{`)))
+		fmt.Printf("  (expected total 0, dropped 5, resolution 1s, probes 3, true, true)\n")
+	default:
+		fmt.Printf("No heartbeat generated\n")
+	}
+
+	// windows with traffic carry the health as well
+	aggregator.AddSample(1234, 100_000, time.Now().UnixNano())
+	aggregator.RotateWindow()
+	select {
+	case metrics := <-metricsChannel:
+		fmt.Printf("  Busy window: total %d, health attached: %v (expected 1, true)\n",
+			metrics.TotalRequests, metrics.Health != nil)
+	default:
+		fmt.Printf("No metrics generated\n")
+	}
+	fmt.Printf("==============================\n")
+}
+
+func testExemplars() {
+	fmt.Printf("Testing slow-request exemplars...\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	aggregator.SetExemplars(3)
+	aggregator.SetRollups([]time.Duration{2 * time.Second})
+	aggregator.windowStart = time.Now().UnixNano() / int64(2*time.Second) * int64(2*time.Second)
+
+	// 1000 shuffled latencies from 1ms to 1s over four PIDs, so every shard sees some
+	rng := rand.New(rand.NewPCG(5, 6))
+	now := time.Now().UnixNano()
+	for _, i := range rng.Perm(1000) {
+		sample := LatencySample{
+			ProcessID: uint32(1000 + i%4),
+			LatencyNs: uint64(i+1) * 1_000_000,
+			Timestamp: now,
+			Status:    200,
+		}
+		if i == 999 {
+			sample.Path = "/slow"
+			sample.Upstream = UpstreamAddr{Family: afInet, Port: 8080, IP: [16]byte{10, 0, 0, 1}}
+		}
+		aggregator.AddLatencySample(sample)
+	}
+	aggregator.RotateWindow()
+
+	// the second window has one request slower than all of the first
+	aggregator.AddSample(2000, 2_000_000_000, now)
+	aggregator.RotateWindow()
+
+	close(metricsChannel)
+	for metrics := range metricsChannel {
+		fmt.Printf("  %s window:", metrics.Resolution)
+		for _, exemplar := range metrics.Exemplars {
+			fmt.Printf(" %dus/pid %d", exemplar.LatencyUs, exemplar.ProcessID)
+			if exemplar.Path != "" {
+				fmt.Printf(" %s via %s", exemplar.Path, exemplar.Upstream)
+			}
+			if !exemplar.Time.Equal(time.Unix(0, now)) {
+				fmt.Printf(" (wrong time %v)", exemplar.Time)
+			}
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("  (expected 1000000us/pid 1003 /slow via 10.0.0.1:8080, 999000us, 998000us; then 2000000us;\n")
+	fmt.Printf("   the 2s rollup 2000000us, 1000000us, 999000us)\n")
+
+	// a negative count disables exemplars instead of panicking at rotation
+	negative := NewWindowAggregator(time.Second, make(chan *WindowMetrics, 1))
+	negative.SetExemplars(-1)
+	negative.AddSample(1234, 1000000, now)
+	negative.RotateWindow()
+	fmt.Printf("  SetExemplars(-1): %d exemplars (expected 0)\n", len((<-negative.metricsChannel).Exemplars))
+
+	// paths are interned, repeated lookups do not allocate
+	paths := make(pathCache)
+	var raw [64]byte
+	copy(raw[:], "/api/users")
+	allocs := allocsPerRun(100, func() { paths.lookup(&raw) })
+	fmt.Printf("  Path %q, %v allocs per repeated lookup (expected \"/api/users\", 0)\n", paths.lookup(&raw), allocs)
+	fmt.Printf("==============================\n")
+}
+
+// Test an nginx hot upgrade without discovery: the pinned path gets a new
+// binary while the old master and workers keep running the replaced one
+func testPinnedBinaryReplace() {
+	fmt.Printf("Testing pinned binary replacement...\n")
+
+	dir, err := os.MkdirTemp("", "trazor-pinned")
+	if err != nil {
+		log.Printf("Creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	self, _ := os.Executable()
+	binary, err := os.ReadFile(self)
+	if err != nil {
+		log.Printf("Reading test binary: %v", err)
+		return
+	}
+	path := filepath.Join(dir, "nginx")
+	if err := os.WriteFile(path, binary, 0o755); err != nil {
+		log.Printf("Writing test binary: %v", err)
+		return
+	}
+
+	// the old processes run the binary that was moved away
+	procRoot := filepath.Join(dir, "proc")
+	os.MkdirAll(filepath.Join(procRoot, "1234"), 0o755)
+	exeLink := filepath.Join(procRoot, "1234", "exe")
+	os.Symlink(path+".old", exeLink)
+
+	pm := NewProbeManager(nil, nil)
+	pm.procRoot = procRoot
+	defer pm.Close()
+	if err := pm.AttachPath(path); err != nil {
+		log.Printf("AttachPath: %v", err)
+		return
+	}
+
+	os.Rename(path, path+".old")
+	os.WriteFile(path, binary, 0o755)
+	pm.CheckPinned()
+	fmt.Printf("  After the upgrade: %d binaries attached (expected 2)\n", pm.AttachedCount())
+	pm.CheckPinned()
+	fmt.Printf("  While the old workers run: %d binaries attached (expected 2)\n", pm.AttachedCount())
+
+	os.Remove(exeLink)
+	pm.CheckPinned()
+	events := pm.Events()
+	last := events[len(events)-1]
+	fmt.Printf("  After the old workers quit: %d binaries attached (expected 1), last event %s %s (expected detach binary replaced)\n",
+		pm.AttachedCount(), last.Action, last.Reason)
+	fmt.Printf("==============================\n")
+}
+
+func testSlowLog() {
+	fmt.Printf("Testing slow request log...\n")
+
+	dir, err := os.MkdirTemp("", "trazor-slow-log")
+	if err != nil {
+		log.Printf("Creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/slow.jsonl"
+	slowLog, err := NewSlowLog(path, 100*time.Millisecond, 1000, 2)
+	if err != nil {
+		log.Printf("NewSlowLog: %v", err)
+		return
+	}
+
+	// 60 requests, every other one above the threshold
+	now := time.Now().UnixNano()
+	for i := range 60 {
+		sample := LatencySample{
+			ProcessID: 1234,
+			LatencyNs: uint64(10+i%2*140+i) * 1_000_000,
+			Timestamp: now,
+			Status:    200,
+			Path:      "/checkout",
+		}
+		if err := slowLog.Record(&sample, ""); err != nil {
+			log.Printf("Record: %v", err)
+			return
+		}
+	}
+	slowLog.Record(&LatencySample{ProcessID: 1, LatencyNs: 1_000_000_000, Timestamp: now}, "myservice:handle")
+	slowLog.Close()
+
+	// the newest entries are in the log, older ones in slow.jsonl.1 and .2, the oldest are gone
+	var lines []string
+	for _, name := range []string{path + ".2", path + ".1", path, path + ".3"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Printf("  %s: missing\n", name[len(dir)+1:])
+			continue
+		}
+		fileLines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		fmt.Printf("  %s: %d bytes, %d entries\n", name[len(dir)+1:], len(data), len(fileLines))
+		lines = append(lines, fileLines...)
+	}
+	fmt.Printf("  (expected at most 1000 bytes per file, slow.jsonl.3 missing)\n")
+
+	var first, last slowLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		log.Printf("Parsing slow log entry: %v", err)
+		return
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		log.Printf("Parsing slow log entry: %v", err)
+		return
+	}
+	fmt.Printf("  Oldest kept: %dus %s, newest: %dus series %q, time ok: %v\n", first.LatencyUs, first.Path,
+		last.LatencyUs, last.Series, last.Time.Equal(time.Unix(0, now)))
+	fmt.Printf("  (expected oldest 179000us /checkout, newest 1000000us series \"myservice:handle\")\n")
+
+	err = slowLog.Record(&LatencySample{LatencyNs: 1_000_000_000}, "")
+	fmt.Printf("  Record after Close: %v (expected error)\n", err)
+	fmt.Printf("==============================\n")
+}
+
+func testSlowStacks() {
+	fmt.Printf("Testing slow stack symbolization...\n")
+
+	// symbolize addresses of this very process: two functions and an unmapped address
+	pid := uint32(os.Getpid())
+	mappings, err := readExecutableMappings(pid)
+	if err != nil {
+		log.Printf("Reading mappings: %v", err)
+		return
+	}
+	leaf := uint64(reflect.ValueOf(foldStack).Pointer()) + 1
+	root := uint64(reflect.ValueOf(testSlowStacks).Pointer()) + 1
+	symbolizer := NewSymbolizer()
+	frames := symbolizer.Frames(pid, mappings, []uint64{leaf, root, 0x10})
+	fmt.Printf("  Frames: %v\n", frames)
+	fmt.Printf("  (expected [main.foldStack main.testSlowStacks [unknown]])\n")
+
+	// stripped binaries fall back to the DWARF subprograms
+	executable, _ := os.Executable()
+	if data, err := openDWARF(executable); err == nil {
+		object := &objectSymbols{symbols: dwarfFunctions(data)}
+		slices.SortFunc(object.symbols, func(a, b symbol) int { return cmp.Compare(a.addr, b.addr) })
+		i := slices.IndexFunc(mappings, func(m processMapping) bool { return leaf >= m.start && leaf < m.end })
+		elfFile, _ := elf.Open(executable)
+		for _, prog := range elfFile.Progs {
+			if prog.Type == elf.PT_LOAD {
+				object.loads = append(object.loads, prog.ProgHeader)
+			}
+		}
+		elfFile.Close()
+		fmt.Printf("  DWARF lookup: %s (expected main.foldStack)\n",
+			object.lookup(leaf-mappings[i].start+mappings[i].offset))
+	} else {
+		fmt.Printf("  DWARF lookup skipped: %v\n", err)
+	}
+
+	folded := FoldedStack{Stack: foldStack("nginx", []string{"epoll_wait", "ngx_process_events", "main"}), Samples: 7}
+	fmt.Printf("  Folded: %s (expected \"nginx;main;ngx_process_events;epoll_wait 7\")\n", folded)
+
+	// the stacks of a window reach its metrics and are summed in the rollups
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	aggregator.SetRollups([]time.Duration{2 * time.Second})
+	aggregator.windowStart = time.Now().UnixNano() / int64(2*time.Second) * int64(2*time.Second)
+	now := time.Now().UnixNano()
+
+	aggregator.AddSample(1000, 900_000_000, now)
+	aggregator.SetSlowStacks([]FoldedStack{{Stack: "nginx;main;a", Samples: 3}, {Stack: "nginx;main;b", Samples: 2}})
+	aggregator.RotateWindow()
+	aggregator.AddSample(1000, 800_000_000, now)
+	aggregator.SetSlowStacks([]FoldedStack{{Stack: "nginx;main;b", Samples: 4}})
+	aggregator.RotateWindow()
+
+	close(metricsChannel)
+	for metrics := range metricsChannel {
+		fmt.Printf("  %s window: %v\n", metrics.Resolution, metrics.SlowStacks)
+	}
+	fmt.Printf("  (expected 1s [nginx;main;a 3 nginx;main;b 2], 1s [nginx;main;b 4],\n")
+	fmt.Printf("   2s [nginx;main;b 6 nginx;main;a 3])\n")
+	fmt.Printf("==============================\n")
+}
+
+func testSchedBreakdown() {
+	fmt.Printf("Testing p99 scheduler breakdown...\n")
+
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	now := time.Now().UnixNano()
+
+	// 1ms to 200ms, half on-CPU and half blocked, except for the slowest 2,
+	// which spend most of their time on the run queue
+	for i := 1; i <= 200; i++ {
+		latency := uint64(i) * 1_000_000
+		sample := LatencySample{ProcessID: 1000, LatencyNs: latency, Timestamp: now, Status: 200}
+		if i >= 199 {
+			sample.CPUNs = 20_000_000
+			sample.RunQueueNs = latency - 30_000_000
+			sample.BlockedNs = 10_000_000
+		} else {
+			sample.CPUNs = latency / 2
+			sample.BlockedNs = latency - sample.CPUNs
+		}
+		aggregator.AddLatencySample(sample)
+	}
+	aggregator.RotateWindow()
+
+	// without scheduler times, e.g. in go mode, there is no breakdown
+	aggregator.AddSample(1000, 5_000_000, now)
+	aggregator.RotateWindow()
+
+	close(metricsChannel)
+	metrics := <-metricsChannel
+	if breakdown := metrics.P99Breakdown; breakdown != nil {
+		fmt.Printf("  P99 %dus over %d requests: latency=%dus cpu=%dus run queue=%dus blocked=%dus\n",
+			metrics.P99Latency, breakdown.Requests, breakdown.LatencyUs,
+			breakdown.CPUUs, breakdown.RunQueueUs, breakdown.BlockedUs)
+	} else {
+		fmt.Printf("  P99 breakdown missing\n")
+	}
+	fmt.Printf("  (expected P99 198000us over 3 requests: latency=199000us cpu=46333us run queue=113000us blocked=39666us)\n")
+	exemplar := metrics.Exemplars[0]
+	fmt.Printf("  Slowest exemplar: cpu=%dus run queue=%dus blocked=%dus (expected 20000, 170000, 10000)\n",
+		exemplar.CPUUs, exemplar.RunQueueUs, exemplar.BlockedUs)
+	metrics = <-metricsChannel
+	fmt.Printf("  Without scheduler times: %v (expected <nil>)\n", metrics.P99Breakdown)
+	fmt.Printf("==============================\n")
+}
+
+func testHostSnapshot() {
+	fmt.Printf("Testing host snapshots...\n")
+
+	dir, err := os.MkdirTemp("", "trazor-host")
+	if err != nil {
+		log.Printf("Creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	procRoot := filepath.Join(dir, "proc")
+	cgroupRoot := filepath.Join(dir, "cgroup")
+	write := func(path, content string) {
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			log.Printf("Writing %s: %v", path, err)
+		}
+	}
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice, 4 CPUs
+	writeStat := func(user, idle, iowait, steal int) {
+		write(filepath.Join(procRoot, "stat"), fmt.Sprintf("cpu  %d 0 0 %d %d 0 0 %d 0 0\n", user, idle, iowait, steal)+
+			"cpu0 0 0 0 0 0 0 0 0 0 0\ncpu1 0 0 0 0 0 0 0 0 0 0\ncpu2 0 0 0 0 0 0 0 0 0 0\ncpu3 0 0 0 0 0 0 0 0 0 0\nintr 0\n")
+	}
+	writePressure := func(resource string, avg10 float64, some, full uint64) {
+		write(filepath.Join(procRoot, "pressure", resource), fmt.Sprintf(
+			"some avg10=%.2f avg60=0.00 avg300=0.00 total=%d\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=%d\n", avg10, some, full))
+	}
+
+	// nginx in a cgroup v2 service, a traced process in the v1 cpu hierarchy
+	write(filepath.Join(procRoot, "100", "cgroup"), "0::/system.slice/nginx.service\n")
+	write(filepath.Join(procRoot, "200", "cgroup"), "4:memory:/app\n2:cpu,cpuacct:/app\n0::/\n")
+	nginxStat := filepath.Join(cgroupRoot, "system.slice", "nginx.service", "cpu.stat")
+	appStat := filepath.Join(cgroupRoot, "cpu", "app", "cpu.stat")
+	write(nginxStat, "usage_usec 1000000\nnr_periods 100\nnr_throttled 0\nthrottled_usec 0\n")
+	write(appStat, "nr_periods 10\nnr_throttled 1\nthrottled_time 5000000\n")
+
+	writeStat(1000, 3000, 0, 0)
+	for _, resource := range pressureResources {
+		writePressure(resource, 0, 0, 0)
+	}
+
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	monitor := newHostMonitor(procRoot, cgroupRoot, clock)
+
+	// first window: 10s, 3 of 4 CPUs busy, 2s of memory stalls
+	now = now.Add(10 * time.Second)
+	writeStat(1000+3000, 3000+500, 300, 200)
+	write(filepath.Join(procRoot, "loadavg"), "3.50 2.25 1.00 4/321 12345\n")
+	writePressure("memory", 12.5, 2_000_000, 500_000)
+
+	snapshot := monitor.Collect(10, []uint32{100, 200, 300})
+	fmt.Printf("  CPUs %d, utilization %.3f, iowait %.3f, steal %.3f, load %.2f/%.2f/%.2f\n",
+		snapshot.CPUs, snapshot.CPUUtilization, snapshot.CPUIOWait, snapshot.CPUSteal,
+		snapshot.Load1, snapshot.Load5, snapshot.Load15)
+	fmt.Printf("  (expected CPUs 4, utilization 0.800, iowait 0.075, steal 0.050, load 3.50/2.25/1.00)\n")
+	memory := snapshot.Pressure["memory"]
+	fmt.Printf("  Memory pressure: some %.2f, full %.2f, avg10 %.1f; cpu some %.2f; cgroups %d\n",
+		memory.Some, memory.Full, memory.SomeAvg10, snapshot.Pressure["cpu"].Some, len(snapshot.Cgroups))
+	fmt.Printf("  (expected some 0.20, full 0.05, avg10 12.5; cpu some 0.00; cgroups 0 until a baseline exists)\n")
+
+	// second window: the nginx cgroup is throttled
+	now = now.Add(10 * time.Second)
+	write(nginxStat, "usage_usec 3500000\nnr_periods 200\nnr_throttled 40\nthrottled_usec 800000\n")
+	write(appStat, "nr_periods 20\nnr_throttled 1\nthrottled_time 5000000\n")
+
+	snapshot = monitor.Collect(20, []uint32{100, 200})
+	for _, cgroup := range snapshot.Cgroups {
+		fmt.Printf("  %s: %d periods, %d throttled, %dus throttled, %dus used\n",
+			cgroup.Cgroup, cgroup.Periods, cgroup.ThrottledPeriods, cgroup.ThrottledUs, cgroup.UsageUs)
+	}
+	fmt.Printf("  (expected /system.slice/nginx.service: 100, 40, 800000, 2500000; cpu:/app: 10, 0, 0, 0)\n")
+
+	// another series of the same window shares the host figures, with its own cgroups
+	other := monitor.Collect(20, []uint32{200})
+	fmt.Printf("  Same window, other series: utilization %.2f, cgroups %d (expected %.2f, 1)\n",
+		other.CPUUtilization, len(other.Cgroups), snapshot.CPUUtilization)
+
+	// every window, idle or not, carries the snapshot
+	metricsChannel := make(chan *WindowMetrics, 10)
+	aggregator := NewWindowAggregator(1*time.Second, metricsChannel)
+	aggregator.SetHostMonitor(monitor)
+	aggregator.AddSample(100, 1_000_000, time.Now().UnixNano())
+	aggregator.RotateWindow()
+	metrics := <-metricsChannel
+	fmt.Printf("  Window host snapshot attached: %v (expected true)\n", metrics.Host != nil)
+	fmt.Printf("==============================\n")
+}
+
 func runTests() {
 	fmt.Printf("Running Go component tests...\n\n")
 
 	testDataStructures()
 	testPercentileCalculation()
 	testWindowAggregator()
+	testTraceTargets()
+	testGoProbeOffsets()
+	testUpstreamSplit()
+	testInterleavedRequests()
+	testSizeMetrics()
+	testStatusMetrics()
+	testSampledMetrics()
+	testMixedRateWindow()
+	testAdaptiveSampleRate()
+	testEventDecoding()
+	testConcurrentIngestion()
+	testQuickSelect()
+	testPercentileMethods()
+	testLatencyHistogram()
+	testRollups()
+	testHoppingWindows()
+	testHeartbeat()
+	testExemplars()
+	testPinnedBinaryReplace()
+	testSlowLog()
+	testSlowStacks()
+	testSchedBreakdown()
+	testHostSnapshot()
 
 	fmt.Printf("All tests completed!\n")
 }
@@ -29,8 +29,143 @@ type WindowMetrics struct {
 	P95Latency       uint64            `json:"p95_latency_us"`
 	P99Latency       uint64            `json:"p99_latency_us"`
 	ProcessBreakdown map[uint32]uint64 `json:"process_breakdown"`
+	Series           string            `json:"series,omitempty"`
+	Resolution       string            `json:"resolution"`
+	Hop              string            `json:"hop"`
 	AgentID          string            `json:"agent_id"`
 	Timestamp        time.Time         `json:"timestamp"`
+
+	Percentiles      map[string]uint64 `json:"percentiles_us"`
+	PercentileMethod string            `json:"percentile_method"`
+
+	Exemplars []struct {
+		Time          time.Time `json:"time"`
+		ProcessID     uint32    `json:"pid"`
+		LatencyUs     uint64    `json:"latency_us"`
+		TTFBUs        uint64    `json:"ttfb_us"`
+		UpstreamUs    uint64    `json:"upstream_us"`
+		Upstream      string    `json:"upstream"`
+		Status        uint16    `json:"status"`
+		RequestBytes  uint64    `json:"request_bytes"`
+		ResponseBytes uint64    `json:"response_bytes"`
+		Path          string    `json:"path"`
+		SampleRate    uint32    `json:"sample_rate"`
+		CPUUs         uint64    `json:"cpu_us"`
+		RunQueueUs    uint64    `json:"run_queue_us"`
+		BlockedUs     uint64    `json:"blocked_us"`
+	} `json:"exemplars"`
+
+	SlowStacks []struct {
+		Stack   string `json:"stack"`
+		Samples uint64 `json:"samples"`
+	} `json:"slow_stacks"`
+
+	Host *struct {
+		CPUs           int     `json:"cpus"`
+		CPUUtilization float64 `json:"cpu_utilization"`
+		CPUIOWait      float64 `json:"cpu_iowait"`
+		CPUSteal       float64 `json:"cpu_steal"`
+		Load1          float64 `json:"load1"`
+		Load5          float64 `json:"load5"`
+		Load15         float64 `json:"load15"`
+		Pressure       map[string]*struct {
+			Some      float64 `json:"some"`
+			Full      float64 `json:"full"`
+			SomeAvg10 float64 `json:"some_avg10"`
+			FullAvg10 float64 `json:"full_avg10"`
+		} `json:"pressure"`
+		Cgroups []struct {
+			Cgroup           string `json:"cgroup"`
+			Periods          uint64 `json:"periods"`
+			ThrottledPeriods uint64 `json:"throttled_periods"`
+			ThrottledUs      uint64 `json:"throttled_us"`
+			UsageUs          uint64 `json:"usage_us"`
+		} `json:"cgroups"`
+	} `json:"host"`
+
+	Health *struct {
+		UptimeSeconds       float64 `json:"uptime_seconds"`
+		AttachedProbes      int     `json:"attached_probes"`
+		RingbufPendingBytes int     `json:"ringbuf_pending_bytes"`
+		RingbufSize         int     `json:"ringbuf_size"`
+		Goroutines          int     `json:"goroutines"`
+		HeapBytes           uint64  `json:"heap_bytes"`
+	} `json:"agent_health"`
+
+	LatencyHistogram *struct {
+		Layout string   `json:"layout"`
+		Bounds []uint64 `json:"bounds_us"`
+		Counts []uint64 `json:"counts"`
+	} `json:"latency_histogram"`
+
+	SampleRate      float64 `json:"sample_rate"`
+	SampledRequests uint64  `json:"sampled_requests"`
+	ExactRequests   uint64  `json:"exact_requests"`
+	DroppedEvents   uint64  `json:"dropped_events"`
+
+	TTFBP50Latency uint64 `json:"ttfb_p50_latency_us"`
+	TTFBP95Latency uint64 `json:"ttfb_p95_latency_us"`
+	TTFBP99Latency uint64 `json:"ttfb_p99_latency_us"`
+
+	RequestBytes          uint64               `json:"request_bytes"`
+	ResponseBytes         uint64               `json:"response_bytes"`
+	RequestThroughput     float64              `json:"request_bytes_per_sec"`
+	ResponseThroughput    float64              `json:"response_bytes_per_sec"`
+	RequestSizeP50        uint64               `json:"request_size_p50_bytes"`
+	RequestSizeP95        uint64               `json:"request_size_p95_bytes"`
+	RequestSizeP99        uint64               `json:"request_size_p99_bytes"`
+	ResponseSizeP50       uint64               `json:"response_size_p50_bytes"`
+	ResponseSizeP95       uint64               `json:"response_size_p95_bytes"`
+	ResponseSizeP99       uint64               `json:"response_size_p99_bytes"`
+	LatencyByResponseSize []*SizeBucketMetrics `json:"latency_by_response_size,omitempty"`
+
+	StatusClasses     map[string]uint64 `json:"status_classes"`
+	StatusCodes       map[uint16]uint64 `json:"status_codes"`
+	ErrorRequests     uint64            `json:"error_requests"`
+	ErrorRatio        float64           `json:"error_ratio"`
+	SuccessP50Latency uint64            `json:"success_p50_latency_us"`
+	SuccessP95Latency uint64            `json:"success_p95_latency_us"`
+	SuccessP99Latency uint64            `json:"success_p99_latency_us"`
+	ErrorP50Latency   uint64            `json:"error_p50_latency_us"`
+	ErrorP95Latency   uint64            `json:"error_p95_latency_us"`
+	ErrorP99Latency   uint64            `json:"error_p99_latency_us"`
+
+	NginxP50Latency    uint64                      `json:"nginx_p50_latency_us"`
+	NginxP95Latency    uint64                      `json:"nginx_p95_latency_us"`
+	NginxP99Latency    uint64                      `json:"nginx_p99_latency_us"`
+	UpstreamRequests   uint64                      `json:"upstream_requests"`
+	UpstreamP50Latency uint64                      `json:"upstream_p50_latency_us"`
+	UpstreamP95Latency uint64                      `json:"upstream_p95_latency_us"`
+	UpstreamP99Latency uint64                      `json:"upstream_p99_latency_us"`
+	UpstreamBreakdown  map[string]*UpstreamMetrics `json:"upstream_breakdown"`
+
+	P99Breakdown *struct {
+		Requests   uint64 `json:"requests"`
+		LatencyUs  uint64 `json:"latency_us"`
+		CPUUs      uint64 `json:"cpu_us"`
+		RunQueueUs uint64 `json:"run_queue_us"`
+		BlockedUs  uint64 `json:"blocked_us"`
+	} `json:"p99_breakdown"`
+}
+
+// SizeBucketMetrics mirrors a row of the latency-by-response-size matrix
+type SizeBucketMetrics struct {
+	Bucket     string  `json:"bucket"`
+	MaxBytes   uint64  `json:"max_bytes"`
+	Requests   uint64  `json:"requests"`
+	AvgLatency float64 `json:"avg_latency_us"`
+	P50Latency uint64  `json:"p50_latency_us"`
+	P95Latency uint64  `json:"p95_latency_us"`
+	P99Latency uint64  `json:"p99_latency_us"`
+}
+
+// UpstreamMetrics mirrors the per-upstream breakdown from the agent
+type UpstreamMetrics struct {
+	Requests   uint64  `json:"requests"`
+	AvgLatency float64 `json:"avg_latency_us"`
+	P50Latency uint64  `json:"p50_latency_us"`
+	P95Latency uint64  `json:"p95_latency_us"`
+	P99Latency uint64  `json:"p99_latency_us"`
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -58,13 +193,92 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		if err := json.Unmarshal(message, &metrics); err == nil {
 			log.Printf("=== Window Metrics Received ===")
 			log.Printf("Agent ID: %s", metrics.AgentID)
-			log.Printf("Window: %d - %d", metrics.WindowStart, metrics.WindowEnd)
+			if metrics.Series != "" {
+				log.Printf("Series: %s", metrics.Series)
+			}
+			if metrics.Hop != "" {
+				log.Printf("Window: %d - %d (%s every %s)", metrics.WindowStart, metrics.WindowEnd, metrics.Resolution, metrics.Hop)
+			} else {
+				log.Printf("Window: %d - %d (%s)", metrics.WindowStart, metrics.WindowEnd, metrics.Resolution)
+			}
 			log.Printf("Total Requests: %d", metrics.TotalRequests)
+			if health := metrics.Health; health != nil {
+				log.Printf("Agent health: up %.0fs, %d probes, ringbuf %d/%d bytes, %d goroutines, heap %d bytes",
+					health.UptimeSeconds, health.AttachedProbes, health.RingbufPendingBytes, health.RingbufSize,
+					health.Goroutines, health.HeapBytes)
+			}
+			if host := metrics.Host; host != nil {
+				log.Printf("Host: %d CPUs, %.0f%% busy, iowait %.0f%%, steal %.0f%%, load %.2f/%.2f/%.2f",
+					host.CPUs, host.CPUUtilization*100, host.CPUIOWait*100, host.CPUSteal*100,
+					host.Load1, host.Load5, host.Load15)
+				for resource, stall := range host.Pressure {
+					log.Printf("  %s pressure: some %.1f%%, full %.1f%%", resource, stall.Some*100, stall.Full*100)
+				}
+				for _, cgroup := range host.Cgroups {
+					log.Printf("  cgroup %s: %d/%d periods throttled, %dμs throttled",
+						cgroup.Cgroup, cgroup.ThrottledPeriods, cgroup.Periods, cgroup.ThrottledUs)
+				}
+			}
+			if metrics.DroppedEvents > 0 {
+				log.Printf("Dropped Events: %d", metrics.DroppedEvents)
+			}
+			if metrics.SampleRate > 1 {
+				log.Printf("Sampling: 1 in %.1f, %d sampled, %d exact",
+					metrics.SampleRate, metrics.SampledRequests, metrics.ExactRequests)
+			}
 			if metrics.TotalRequests > 0 {
 				log.Printf("Latency Stats (μs): Avg=%.2f, Min=%d, Max=%d",
 					metrics.AvgLatency, metrics.MinLatency, metrics.MaxLatency)
 				log.Printf("Percentiles (μs): P50=%d, P95=%d, P99=%d",
 					metrics.P50Latency, metrics.P95Latency, metrics.P99Latency)
+				if len(metrics.Percentiles) > 0 {
+					log.Printf("Configured percentiles (μs, %s): %v", metrics.PercentileMethod, metrics.Percentiles)
+				}
+				for _, exemplar := range metrics.Exemplars {
+					log.Printf("  Slow request: %dμs at %s, PID %d, status %d, path %q, upstream %q",
+						exemplar.LatencyUs, exemplar.Time.Format(time.RFC3339Nano), exemplar.ProcessID,
+						exemplar.Status, exemplar.Path, exemplar.Upstream)
+				}
+				for _, stack := range metrics.SlowStacks {
+					log.Printf("  Slow stack: %s %d", stack.Stack, stack.Samples)
+				}
+				if histogram := metrics.LatencyHistogram; histogram != nil {
+					log.Printf("Histogram (%s, le μs): %v → %v", histogram.Layout, histogram.Bounds, histogram.Counts)
+				}
+			}
+			if metrics.TotalRequests > 0 {
+				log.Printf("Bytes: request=%d (%.0f/s), response=%d (%.0f/s)",
+					metrics.RequestBytes, metrics.RequestThroughput,
+					metrics.ResponseBytes, metrics.ResponseThroughput)
+				log.Printf("Response size (bytes): P50=%d, P95=%d, P99=%d",
+					metrics.ResponseSizeP50, metrics.ResponseSizeP95, metrics.ResponseSizeP99)
+				for _, bucket := range metrics.LatencyByResponseSize {
+					log.Printf("  %s: %d requests, P50=%d, P99=%d",
+						bucket.Bucket, bucket.Requests, bucket.P50Latency, bucket.P99Latency)
+				}
+			}
+			if len(metrics.StatusClasses) > 0 {
+				log.Printf("Status: classes=%v, codes=%v, errors=%d (%.2f%%)",
+					metrics.StatusClasses, metrics.StatusCodes, metrics.ErrorRequests, metrics.ErrorRatio*100)
+				log.Printf("Success (μs): P50=%d, P95=%d, P99=%d; Error (μs): P50=%d, P95=%d, P99=%d",
+					metrics.SuccessP50Latency, metrics.SuccessP95Latency, metrics.SuccessP99Latency,
+					metrics.ErrorP50Latency, metrics.ErrorP95Latency, metrics.ErrorP99Latency)
+			}
+			if metrics.TTFBP99Latency > 0 {
+				log.Printf("TTFB (μs): P50=%d, P95=%d, P99=%d",
+					metrics.TTFBP50Latency, metrics.TTFBP95Latency, metrics.TTFBP99Latency)
+			}
+			if metrics.UpstreamRequests > 0 {
+				log.Printf("Upstream (μs): %d requests, P50=%d, P95=%d, P99=%d; nginx-internal P99=%d",
+					metrics.UpstreamRequests, metrics.UpstreamP50Latency, metrics.UpstreamP95Latency,
+					metrics.UpstreamP99Latency, metrics.NginxP99Latency)
+				for addr, upstream := range metrics.UpstreamBreakdown {
+					log.Printf("  %s: %d requests, P99=%d", addr, upstream.Requests, upstream.P99Latency)
+				}
+			}
+			if breakdown := metrics.P99Breakdown; breakdown != nil {
+				log.Printf("P99 scheduler split (μs, %d requests, avg %d): cpu=%d, run queue=%d, blocked=%d",
+					breakdown.Requests, breakdown.LatencyUs, breakdown.CPUUs, breakdown.RunQueueUs, breakdown.BlockedUs)
 			}
 			log.Printf("Process Breakdown: %v", metrics.ProcessBreakdown)
 			log.Printf("Timestamp: %s", metrics.Timestamp.Format(time.RFC3339))
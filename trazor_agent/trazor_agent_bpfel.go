@@ -8,10 +8,93 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"structs"
 
 	"github.com/cilium/ebpf"
 )
 
+type trazor_agentFuncKey struct {
+	_       structs.HostLayout
+	PidTgid uint64
+	FuncId  uint64
+}
+
+type trazor_agentGoOffsets struct {
+	_          structs.HostLayout
+	Goid       uint64
+	RequestUrl uint64
+	UrlPath    uint64
+}
+
+type trazor_agentGoReqInfo struct {
+	_     structs.HostLayout
+	Start uint64
+	Path  [64]int8
+}
+
+type trazor_agentGoReqKey struct {
+	_    structs.HostLayout
+	Pid  uint32
+	Pad  uint32
+	Goid uint64
+}
+
+type trazor_agentInFlight struct {
+	_     structs.HostLayout
+	Start uint64
+	Count uint32
+	_     [4]byte
+}
+
+type trazor_agentNginxOffsets struct {
+	_                    structs.HostLayout
+	UpstreamSockaddr     uint64
+	RequestConnection    uint64
+	RequestContentLength uint64
+	ConnectionSent       uint64
+	RequestStatus        uint64
+}
+
+type trazor_agentReqKey struct {
+	_   structs.HostLayout
+	Pid uint32
+	Pad uint32
+	R   uint64
+}
+
+type trazor_agentSchedInfo struct {
+	_         structs.HostLayout
+	Last      uint64
+	CpuNs     uint64
+	RunqNs    uint64
+	BlockedNs uint64
+	State     uint32
+	_         [4]byte
+}
+
+type trazor_agentSchedTotals struct {
+	_         structs.HostLayout
+	CpuNs     uint64
+	RunqNs    uint64
+	BlockedNs uint64
+}
+
+type trazor_agentStackKey struct {
+	_       structs.HostLayout
+	Pid     uint32
+	StackId int32
+}
+
+type trazor_agentUpstreamInfo struct {
+	_        structs.HostLayout
+	Start    uint64
+	Duration uint64
+	Family   uint16
+	Port     uint16
+	Addr     [16]uint8
+	_        [4]byte
+}
+
 // loadTrazor_agent returns the embedded CollectionSpec for trazor_agent.
 func loadTrazor_agent() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_Trazor_agentBytes)
@@ -54,22 +137,52 @@ type trazor_agentSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type trazor_agentProgramSpecs struct {
-	GetConnStart    *ebpf.ProgramSpec `ebpf:"get_conn_start"`
-	GetLatencyOnEnd *ebpf.ProgramSpec `ebpf:"get_latency_on_end"`
+	GetConnStart      *ebpf.ProgramSpec `ebpf:"get_conn_start"`
+	GetHeaderSent     *ebpf.ProgramSpec `ebpf:"get_header_sent"`
+	GetLatencyOnEnd   *ebpf.ProgramSpec `ebpf:"get_latency_on_end"`
+	GetUpstreamEnd    *ebpf.ProgramSpec `ebpf:"get_upstream_end"`
+	GetUpstreamStart  *ebpf.ProgramSpec `ebpf:"get_upstream_start"`
+	GoHttpServeEnd    *ebpf.ProgramSpec `ebpf:"go_http_serve_end"`
+	GoHttpServeStart  *ebpf.ProgramSpec `ebpf:"go_http_serve_start"`
+	HandleSchedSwitch *ebpf.ProgramSpec `ebpf:"handle_sched_switch"`
+	HandleSchedWakeup *ebpf.ProgramSpec `ebpf:"handle_sched_wakeup"`
+	SampleSlowStack   *ebpf.ProgramSpec `ebpf:"sample_slow_stack"`
+	TraceFuncEntry    *ebpf.ProgramSpec `ebpf:"trace_func_entry"`
+	TraceFuncExit     *ebpf.ProgramSpec `ebpf:"trace_func_exit"`
 }
 
 // trazor_agentMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type trazor_agentMapSpecs struct {
-	Events  *ebpf.MapSpec `ebpf:"events"`
-	Latency *ebpf.MapSpec `ebpf:"latency"`
+	ConnSent      *ebpf.MapSpec `ebpf:"conn_sent"`
+	DroppedEvents *ebpf.MapSpec `ebpf:"dropped_events"`
+	Events        *ebpf.MapSpec `ebpf:"events"`
+	FuncEvents    *ebpf.MapSpec `ebpf:"func_events"`
+	FuncStart     *ebpf.MapSpec `ebpf:"func_start"`
+	GoOffsets     *ebpf.MapSpec `ebpf:"go_offsets"`
+	GoRequests    *ebpf.MapSpec `ebpf:"go_requests"`
+	HeaderSent    *ebpf.MapSpec `ebpf:"header_sent"`
+	InFlight      *ebpf.MapSpec `ebpf:"in_flight"`
+	NginxOffsets  *ebpf.MapSpec `ebpf:"nginx_offsets"`
+	RequestCount  *ebpf.MapSpec `ebpf:"request_count"`
+	RequestStart  *ebpf.MapSpec `ebpf:"request_start"`
+	SchedStart    *ebpf.MapSpec `ebpf:"sched_start"`
+	SchedTimes    *ebpf.MapSpec `ebpf:"sched_times"`
+	SlowStacks    *ebpf.MapSpec `ebpf:"slow_stacks"`
+	Stacks        *ebpf.MapSpec `ebpf:"stacks"`
+	Upstream      *ebpf.MapSpec `ebpf:"upstream"`
 }
 
 // trazor_agentVariableSpecs contains global variables before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type trazor_agentVariableSpecs struct {
+	DebugEvents      *ebpf.VariableSpec `ebpf:"debug_events"`
+	SampleRate       *ebpf.VariableSpec `ebpf:"sample_rate"`
+	SchedBreakdown   *ebpf.VariableSpec `ebpf:"sched_breakdown"`
+	SlowThresholdNs  *ebpf.VariableSpec `ebpf:"slow_threshold_ns"`
+	StackThresholdNs *ebpf.VariableSpec `ebpf:"stack_threshold_ns"`
 }
 
 // trazor_agentObjects contains all objects after they have been loaded into the kernel.
@@ -92,14 +205,44 @@ func (o *trazor_agentObjects) Close() error {
 //
 // It can be passed to loadTrazor_agentObjects or ebpf.CollectionSpec.LoadAndAssign.
 type trazor_agentMaps struct {
-	Events  *ebpf.Map `ebpf:"events"`
-	Latency *ebpf.Map `ebpf:"latency"`
+	ConnSent      *ebpf.Map `ebpf:"conn_sent"`
+	DroppedEvents *ebpf.Map `ebpf:"dropped_events"`
+	Events        *ebpf.Map `ebpf:"events"`
+	FuncEvents    *ebpf.Map `ebpf:"func_events"`
+	FuncStart     *ebpf.Map `ebpf:"func_start"`
+	GoOffsets     *ebpf.Map `ebpf:"go_offsets"`
+	GoRequests    *ebpf.Map `ebpf:"go_requests"`
+	HeaderSent    *ebpf.Map `ebpf:"header_sent"`
+	InFlight      *ebpf.Map `ebpf:"in_flight"`
+	NginxOffsets  *ebpf.Map `ebpf:"nginx_offsets"`
+	RequestCount  *ebpf.Map `ebpf:"request_count"`
+	RequestStart  *ebpf.Map `ebpf:"request_start"`
+	SchedStart    *ebpf.Map `ebpf:"sched_start"`
+	SchedTimes    *ebpf.Map `ebpf:"sched_times"`
+	SlowStacks    *ebpf.Map `ebpf:"slow_stacks"`
+	Stacks        *ebpf.Map `ebpf:"stacks"`
+	Upstream      *ebpf.Map `ebpf:"upstream"`
 }
 
 func (m *trazor_agentMaps) Close() error {
 	return _Trazor_agentClose(
+		m.ConnSent,
+		m.DroppedEvents,
 		m.Events,
-		m.Latency,
+		m.FuncEvents,
+		m.FuncStart,
+		m.GoOffsets,
+		m.GoRequests,
+		m.HeaderSent,
+		m.InFlight,
+		m.NginxOffsets,
+		m.RequestCount,
+		m.RequestStart,
+		m.SchedStart,
+		m.SchedTimes,
+		m.SlowStacks,
+		m.Stacks,
+		m.Upstream,
 	)
 }
 
@@ -107,20 +250,45 @@ func (m *trazor_agentMaps) Close() error {
 //
 // It can be passed to loadTrazor_agentObjects or ebpf.CollectionSpec.LoadAndAssign.
 type trazor_agentVariables struct {
+	DebugEvents      *ebpf.Variable `ebpf:"debug_events"`
+	SampleRate       *ebpf.Variable `ebpf:"sample_rate"`
+	SchedBreakdown   *ebpf.Variable `ebpf:"sched_breakdown"`
+	SlowThresholdNs  *ebpf.Variable `ebpf:"slow_threshold_ns"`
+	StackThresholdNs *ebpf.Variable `ebpf:"stack_threshold_ns"`
 }
 
 // trazor_agentPrograms contains all programs after they have been loaded into the kernel.
 //
 // It can be passed to loadTrazor_agentObjects or ebpf.CollectionSpec.LoadAndAssign.
 type trazor_agentPrograms struct {
-	GetConnStart    *ebpf.Program `ebpf:"get_conn_start"`
-	GetLatencyOnEnd *ebpf.Program `ebpf:"get_latency_on_end"`
+	GetConnStart      *ebpf.Program `ebpf:"get_conn_start"`
+	GetHeaderSent     *ebpf.Program `ebpf:"get_header_sent"`
+	GetLatencyOnEnd   *ebpf.Program `ebpf:"get_latency_on_end"`
+	GetUpstreamEnd    *ebpf.Program `ebpf:"get_upstream_end"`
+	GetUpstreamStart  *ebpf.Program `ebpf:"get_upstream_start"`
+	GoHttpServeEnd    *ebpf.Program `ebpf:"go_http_serve_end"`
+	GoHttpServeStart  *ebpf.Program `ebpf:"go_http_serve_start"`
+	HandleSchedSwitch *ebpf.Program `ebpf:"handle_sched_switch"`
+	HandleSchedWakeup *ebpf.Program `ebpf:"handle_sched_wakeup"`
+	SampleSlowStack   *ebpf.Program `ebpf:"sample_slow_stack"`
+	TraceFuncEntry    *ebpf.Program `ebpf:"trace_func_entry"`
+	TraceFuncExit     *ebpf.Program `ebpf:"trace_func_exit"`
 }
 
 func (p *trazor_agentPrograms) Close() error {
 	return _Trazor_agentClose(
 		p.GetConnStart,
+		p.GetHeaderSent,
 		p.GetLatencyOnEnd,
+		p.GetUpstreamEnd,
+		p.GetUpstreamStart,
+		p.GoHttpServeEnd,
+		p.GoHttpServeStart,
+		p.HandleSchedSwitch,
+		p.HandleSchedWakeup,
+		p.SampleSlowStack,
+		p.TraceFuncEntry,
+		p.TraceFuncExit,
 	)
 }
 
@@ -1,19 +1,51 @@
 package main
 
 import (
+	"maps"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// WindowAggregator manages time-based windowing of latency data
+// WindowAggregator manages time-based windowing of latency data. Samples are
+// ingested into sharded, double-buffered window buffers; rotation swaps the
+// active buffer and computes metrics without blocking ingestion.
 type WindowAggregator struct {
-	mutex          sync.RWMutex
-	currentWindow  map[uint32][]uint64 // PID → latencies
+	active         atomic.Pointer[windowBuffer]
+	rotateMutex    sync.Mutex // serializes rotations so windows are emitted in order
+	mutex          sync.Mutex // guards the window state below
 	windowStart    int64
 	windowDuration time.Duration
 	metricsChannel chan *WindowMetrics
-	samplesBuffer  []LatencySample
-	maxSamples     int
+	maxExemplars   atomic.Int32 // slowest requests reported per window
+	series         string
+	percentiles    []float64        // extra latency percentiles reported in WindowMetrics.Percentiles
+	method         PercentileMethod // estimation method of every percentile
+	histogram      *HistogramLayout // latency histogram buckets, nil to skip the histogram
+	exactRequests  uint64           // completed requests counted in the kernel, sampled or not
+	droppedEvents  uint64           // sampled events lost to a full ringbuf
+	slowStacks     []FoldedStack    // user stacks sampled during slow requests of the current window
+	rollups        []*rollup        // coarser resolutions, finest first, guarded by rotateMutex
+	hopping        []*hoppingWindow // hopping windows, guarded by rotateMutex
+	health         *HealthMonitor   // emits windows without samples as heartbeats when set
+	host           *HostMonitor     // attaches a host snapshot to every window when set
+}
+
+// closedWindow is a rotated-out window whose metrics are being computed
+type closedWindow struct {
+	start         int64
+	series        string
+	percentiles   []float64
+	method        PercentileMethod
+	histogram     *HistogramLayout
+	samples       map[uint32][]LatencySample // PID → samples
+	exemplars     []LatencySample            // slowest samples, slowest first
+	exactRequests uint64
+	droppedEvents uint64
+	slowStacks    []FoldedStack
+	sketch        bool // build the sketches for the rollups and hopping windows
 }
 
 // NewWindowAggregator creates a new WindowAggregator
@@ -21,78 +53,321 @@ func NewWindowAggregator(windowDuration time.Duration, metricsChannel chan *Wind
 	now := time.Now().UnixNano()
 	alignedStart := (now / int64(windowDuration)) * int64(windowDuration)
 
-	return &WindowAggregator{
-		currentWindow:  make(map[uint32][]uint64),
+	wa := &WindowAggregator{
 		windowStart:    alignedStart,
 		windowDuration: windowDuration,
 		metricsChannel: metricsChannel,
-		samplesBuffer:  make([]LatencySample, 0, 1000),
-		maxSamples:     1000,
 	}
+	wa.maxExemplars.Store(defaultExemplars)
+	wa.active.Store(newWindowBuffer())
+	return wa
 }
 
-// AddSample adds a latency sample to the current window
-func (wa *WindowAggregator) AddSample(processID uint32, latencyNs uint64, timestamp int64) {
+// SetSeries labels every window emitted by this aggregator, e.g. with a traced function
+func (wa *WindowAggregator) SetSeries(series string) {
 	wa.mutex.Lock()
 	defer wa.mutex.Unlock()
+	wa.series = series
+}
+
+// Series returns the label set with SetSeries
+func (wa *WindowAggregator) Series() string {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	return wa.series
+}
+
+// SetPercentiles configures the latency percentiles of WindowMetrics.Percentiles
+// and the estimation method of all percentiles
+func (wa *WindowAggregator) SetPercentiles(percentiles []float64, method PercentileMethod) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.percentiles = percentiles
+	wa.method = method
+}
+
+// SetHistogramLayout configures the buckets of WindowMetrics.LatencyHistogram,
+// nil disables the histogram
+func (wa *WindowAggregator) SetHistogramLayout(layout *HistogramLayout) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.histogram = layout
+}
 
-	wa.currentWindow[processID] = append(wa.currentWindow[processID], latencyNs)
+// defaultExemplars is the number of slowest requests reported per window
+const defaultExemplars = 10
 
-	sample := LatencySample{
+// SetExemplars sets the number of slowest requests reported as exemplars of
+// every window, 0 disables exemplars. Negative counts are treated as 0.
+func (wa *WindowAggregator) SetExemplars(count int) {
+	wa.maxExemplars.Store(int32(min(max(count, 0), math.MaxInt32)))
+}
+
+// SetRollups merges the windows of this aggregator into rollups of the given
+// resolutions, finest first, e.g. 1m, 5m and 1h. Each rollup is emitted as its
+// own WindowMetrics when a window ends on a multiple of its resolution.
+func (wa *WindowAggregator) SetRollups(resolutions []time.Duration) {
+	wa.rotateMutex.Lock()
+	defer wa.rotateMutex.Unlock()
+
+	wa.rollups = nil
+	for _, resolution := range resolutions {
+		wa.rollups = append(wa.rollups, &rollup{resolution: resolution})
+	}
+}
+
+// SetHoppingWindows emits, at every hop, a window merged from the sub-windows
+// of the last size. Sub-windows are the windows of this aggregator.
+func (wa *WindowAggregator) SetHoppingWindows(configs []HoppingWindowConfig) {
+	wa.rotateMutex.Lock()
+	defer wa.rotateMutex.Unlock()
+
+	wa.hopping = nil
+	for _, config := range configs {
+		wa.hopping = append(wa.hopping, newHoppingWindow(config, wa.windowDuration))
+	}
+}
+
+// SetHeartbeat makes RotateWindow emit windows without samples too, with
+// total_requests 0, and attaches the agent health to every window. nil disables
+// heartbeats.
+func (wa *WindowAggregator) SetHeartbeat(health *HealthMonitor) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.health = health
+}
+
+// SetHostMonitor attaches a snapshot of the host and of the cgroups of the
+// window's processes to every window. nil disables the snapshot.
+func (wa *WindowAggregator) SetHostMonitor(host *HostMonitor) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.host = host
+}
+
+// SetKernelCounts records the exact number of requests completed in the current
+// window, as counted in the kernel before sampling, and the events it dropped
+func (wa *WindowAggregator) SetKernelCounts(completed, dropped uint64) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.exactRequests = completed
+	wa.droppedEvents = dropped
+}
+
+// SetSlowStacks records the user stacks sampled during slow requests of the
+// current window
+func (wa *WindowAggregator) SetSlowStacks(stacks []FoldedStack) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.slowStacks = stacks
+}
+
+// AddSample adds a latency sample to the current window
+func (wa *WindowAggregator) AddSample(processID uint32, latencyNs uint64, timestamp int64) {
+	wa.AddLatencySample(LatencySample{
 		ProcessID: processID,
 		LatencyNs: latencyNs,
 		Timestamp: timestamp,
-	}
-
-	wa.samplesBuffer = append(wa.samplesBuffer, sample)
+	})
+}
 
-	if len(wa.samplesBuffer) >= wa.maxSamples {
-		wa.samplesBuffer = wa.samplesBuffer[len(wa.samplesBuffer)/2:]
+// AddLatencySample adds a sample with all of its captured request attributes to
+// the current window. It is safe for concurrent use by several ringbuf consumers.
+func (wa *WindowAggregator) AddLatencySample(sample LatencySample) {
+	// a sealed buffer means a rotation swapped it out after it was loaded
+	maxExemplars := int(wa.maxExemplars.Load())
+	for !wa.active.Load().add(sample, maxExemplars) {
 	}
 }
 
 // RotateWindow rotates to the next time window and emits metrics for the completed window
 func (wa *WindowAggregator) RotateWindow() {
+	wa.rotateMutex.Lock()
+	defer wa.rotateMutex.Unlock()
+
+	closed := wa.active.Swap(newWindowBuffer())
+
 	wa.mutex.Lock()
-	defer wa.mutex.Unlock()
+	window := closedWindow{
+		start:         wa.windowStart,
+		series:        wa.series,
+		percentiles:   wa.percentiles,
+		method:        wa.method,
+		histogram:     wa.histogram,
+		exactRequests: wa.exactRequests,
+		droppedEvents: wa.droppedEvents,
+		slowStacks:    wa.slowStacks,
+	}
+	health := wa.health
+	host := wa.host
+	wa.exactRequests = 0
+	wa.droppedEvents = 0
+	wa.slowStacks = nil
+	wa.windowStart += int64(wa.windowDuration)
+	wa.mutex.Unlock()
+
+	// new samples already go to the new buffer, the closed one is read off the hot path
+	window.samples, window.exemplars = closed.seal(int(wa.maxExemplars.Load()))
+	window.sketch = len(wa.rollups) > 0 || len(wa.hopping) > 0
+
+	var metrics *WindowMetrics
+	if len(window.samples) > 0 {
+		metrics = wa.calculateMetrics(&window)
+	} else if health != nil {
+		// without traffic, an empty window tells the collector the agent is alive
+		metrics = wa.newMetrics(&window)
+	}
+	end := window.start + int64(wa.windowDuration)
+
+	// the host is read every window, so its deltas always cover exactly one
+	var snapshot *HostSnapshot
+	if host != nil {
+		snapshot = host.Collect(end, slices.Collect(maps.Keys(window.samples)))
+	}
+
+	if metrics != nil {
+		if health != nil {
+			metrics.Health = health.Collect()
+		}
+		metrics.Host = snapshot
+		wa.emit(metrics)
+	}
 
-	if len(wa.currentWindow) == 0 {
-		wa.windowStart += int64(wa.windowDuration)
-		return
+	wa.rotateRollups(metrics, end, window.percentiles)
+
+	for _, hw := range wa.hopping {
+		if hopped := hw.add(metrics, end, window.percentiles); hopped != nil {
+			wa.emit(hopped)
+		}
 	}
+}
 
-	metrics := wa.calculateMetrics()
+// rotateRollups merges a closed window into the finest rollup and cascades every
+// rollup that ends with it into the next coarser one. metrics is nil for a window
+// without samples unless heartbeats are enabled, rollups still close on time.
+func (wa *WindowAggregator) rotateRollups(metrics *WindowMetrics, end int64, percentiles []float64) {
+	next := metrics
+	for _, r := range wa.rollups {
+		if next != nil {
+			r.add(next)
+		}
+		// coarser resolutions are multiples of this one, they cannot end here either
+		if end%int64(r.resolution) != 0 {
+			return
+		}
+		next = r.close(end, percentiles)
+		if next != nil {
+			wa.emit(next)
+		}
+	}
+}
 
+// emit sends metrics without blocking, dropping them if the channel is full
+func (wa *WindowAggregator) emit(metrics *WindowMetrics) {
 	select {
 	case wa.metricsChannel <- metrics:
 	default:
 	}
-
-	wa.currentWindow = make(map[uint32][]uint64)
-	wa.windowStart += int64(wa.windowDuration)
 }
 
-// calculateMetrics computes aggregated metrics for the current window
-func (wa *WindowAggregator) calculateMetrics() *WindowMetrics {
+// newMetrics creates the metrics of a closed window with its window fields and
+// kernel counts set, as reported for a window without samples
+func (wa *WindowAggregator) newMetrics(window *closedWindow) *WindowMetrics {
 	metrics := NewWindowMetrics()
-	metrics.WindowStart = wa.windowStart
-	metrics.WindowEnd = wa.windowStart + int64(wa.windowDuration)
+	metrics.WindowStart = window.start
+	metrics.WindowEnd = window.start + int64(wa.windowDuration)
+	metrics.Series = window.series
+	metrics.Resolution = formatResolution(wa.windowDuration)
+	metrics.PercentileMethod = window.method.String()
+	metrics.ExactRequests = window.exactRequests
+	metrics.DroppedEvents = window.droppedEvents
+	metrics.SlowStacks = window.slowStacks
+	return metrics
+}
+
+// calculateMetrics computes aggregated metrics for a closed window
+func (wa *WindowAggregator) calculateMetrics(window *closedWindow) *WindowMetrics {
+	metrics := wa.newMetrics(window)
+	method := window.method
 
-	var allLatencies []uint64
-	var totalLatency uint64
+	var allLatencies weightedValues
 	totalRequests := uint64(0)
 
 	minLatency := ^uint64(0) // max uint64
 	maxLatency := uint64(0)
 
-	for processID, latencies := range wa.currentWindow {
-		processRequests := uint64(len(latencies))
-		metrics.ProcessBreakdown[processID] = processRequests
-		totalRequests += processRequests
+	// nginx-internal time is the total minus the time spent waiting on upstreams
+	var nginxLatencies, upstreamLatencies, ttfbLatencies weightedValues
+	upstreamByAddr := make(map[UpstreamAddr]*weightedValues)
+
+	var requestSizes, responseSizes weightedValues
+	latenciesBySize := make([]weightedValues, len(responseSizeBuckets))
+
+	var successLatencies, errorLatencies weightedValues
+	var knownStatusRequests uint64
+	hasSchedTimes := false // only nginx requests with -sched-breakdown carry them
 
-		for _, latency := range latencies {
-			allLatencies = append(allLatencies, latency)
-			totalLatency += latency
+	var histogram *LatencyHistogram
+	if window.histogram != nil {
+		histogram = NewLatencyHistogram(window.histogram)
+	}
+
+	// samples stand for as many requests as their sampling rate, which may change
+	// during a window, so counts and percentiles are weighted by it
+	for processID, samples := range window.samples {
+		var processRequests uint64
+
+		for _, sample := range samples {
+			weight := sample.weight()
+			processRequests += weight
+
+			latency := sample.LatencyNs
+			allLatencies.add(latency, weight)
+			if histogram != nil {
+				histogram.Add(latency, weight)
+			}
+
+			// without the nginx struct offsets, and for Go and traced functions,
+			// the sizes are unknown rather than 0
+			if sample.SizesKnown {
+				metrics.RequestBytes += sample.RequestBytes * weight
+				metrics.ResponseBytes += sample.BytesSent * weight
+				requestSizes.add(sample.RequestBytes, weight)
+				responseSizes.add(sample.BytesSent, weight)
+				latenciesBySize[responseSizeBucket(sample.BytesSent)].add(latency, weight)
+			}
+
+			if class := statusClass(sample.Status); class != "" {
+				metrics.StatusClasses[class] += weight
+				metrics.StatusCodes[sample.Status] += weight
+				knownStatusRequests += weight
+				if sample.Status >= 500 {
+					metrics.ErrorRequests += weight
+					errorLatencies.add(latency, weight)
+				} else {
+					successLatencies.add(latency, weight)
+				}
+			}
+
+			if sample.CPUNs > 0 {
+				hasSchedTimes = true
+			}
+
+			if sample.TTFBNs > 0 {
+				ttfbLatencies.add(sample.TTFBNs, weight)
+			}
+
+			upstream := min(sample.UpstreamNs, latency)
+			nginxLatencies.add(latency-upstream, weight)
+			if sample.UpstreamNs > 0 {
+				upstreamLatencies.add(sample.UpstreamNs, weight)
+				byAddr := upstreamByAddr[sample.Upstream]
+				if byAddr == nil {
+					byAddr = &weightedValues{}
+					upstreamByAddr[sample.Upstream] = byAddr
+				}
+				byAddr.add(sample.UpstreamNs, weight)
+			}
 
 			if latency < minLatency {
 				minLatency = latency
@@ -101,20 +376,100 @@ func (wa *WindowAggregator) calculateMetrics() *WindowMetrics {
 				maxLatency = latency
 			}
 		}
+
+		metrics.ProcessBreakdown[processID] = processRequests
+		totalRequests += processRequests
 	}
 
 	metrics.TotalRequests = totalRequests
+	metrics.SampledRequests = uint64(allLatencies.len())
 	metrics.MinLatency = minLatency / 1000 // Convert to microseconds
 	metrics.MaxLatency = maxLatency / 1000 // Convert to microseconds
+	metrics.LatencyHistogram = histogram
+	metrics.Exemplars = newExemplars(window.exemplars)
 
-	if totalRequests > 0 {
-		metrics.AvgLatency = float64(totalLatency) / float64(totalRequests) / 1000.0 // Convert to microseconds
+	if allLatencies.len() > 0 {
+		metrics.AvgLatency = allLatencies.avgLatency()
+		metrics.SampleRate = float64(totalRequests) / float64(allLatencies.len())
 	}
 
-	if len(allLatencies) > 0 {
-		metrics.P50Latency = CalculatePercentile(allLatencies, 50) / 1000
-		metrics.P95Latency = CalculatePercentile(allLatencies, 95) / 1000
-		metrics.P99Latency = CalculatePercentile(allLatencies, 99) / 1000
+	if allLatencies.len() > 0 {
+		// the standard and configured percentiles share one selection pass
+		all := allLatencies.percentiles(slices.Concat(window.percentiles, standardPercentiles), method)
+		metrics.P50Latency = all[50] / 1000
+		metrics.P95Latency = all[95] / 1000
+		metrics.P99Latency = all[99] / 1000
+		for _, percentile := range window.percentiles {
+			metrics.Percentiles[PercentileLabel(percentile)] = all[percentile] / 1000
+		}
+
+		metrics.NginxP50Latency, metrics.NginxP95Latency, metrics.NginxP99Latency = nginxLatencies.latencyPercentiles(method)
+
+		if hasSchedTimes {
+			metrics.P99Breakdown = newLatencyBreakdown(window.samples, all[99])
+		}
+	}
+
+	seconds := wa.windowDuration.Seconds()
+	metrics.RequestThroughput = float64(metrics.RequestBytes) / seconds
+	metrics.ResponseThroughput = float64(metrics.ResponseBytes) / seconds
+
+	if responseSizes.len() > 0 {
+		metrics.RequestSizeP50, metrics.RequestSizeP95, metrics.RequestSizeP99 = requestSizes.standardPercentiles(method)
+		metrics.ResponseSizeP50, metrics.ResponseSizeP95, metrics.ResponseSizeP99 = responseSizes.standardPercentiles(method)
+
+		for i := range latenciesBySize {
+			if latenciesBySize[i].len() == 0 {
+				continue
+			}
+			metrics.LatencyByResponseSize = append(metrics.LatencyByResponseSize,
+				newSizeBucketMetrics(i, &latenciesBySize[i], method))
+		}
+	}
+
+	if window.sketch {
+		sketches := &windowSketches{
+			latency:        allLatencies.sketch(),
+			nginx:          nginxLatencies.sketch(),
+			ttfb:           ttfbLatencies.sketch(),
+			upstream:       upstreamLatencies.sketch(),
+			upstreamByAddr: make(map[string]*LatencySketch, len(upstreamByAddr)),
+			success:        successLatencies.sketch(),
+			errors:         errorLatencies.sketch(),
+			requestSizes:   requestSizes.sketch(),
+			responseSizes:  responseSizes.sketch(),
+			latencyBySize:  make([]*LatencySketch, len(latenciesBySize)),
+		}
+		for addr, latencies := range upstreamByAddr {
+			sketches.upstreamByAddr[addr.String()] = latencies.sketch()
+		}
+		for i := range latenciesBySize {
+			sketches.latencyBySize[i] = latenciesBySize[i].sketch()
+		}
+		metrics.sketches = sketches
+	}
+
+	if knownStatusRequests > 0 {
+		metrics.ErrorRatio = float64(metrics.ErrorRequests) / float64(knownStatusRequests)
+	}
+	if successLatencies.len() > 0 {
+		metrics.SuccessP50Latency, metrics.SuccessP95Latency, metrics.SuccessP99Latency = successLatencies.latencyPercentiles(method)
+	}
+	if errorLatencies.len() > 0 {
+		metrics.ErrorP50Latency, metrics.ErrorP95Latency, metrics.ErrorP99Latency = errorLatencies.latencyPercentiles(method)
+	}
+
+	if ttfbLatencies.len() > 0 {
+		metrics.TTFBP50Latency, metrics.TTFBP95Latency, metrics.TTFBP99Latency = ttfbLatencies.latencyPercentiles(method)
+	}
+
+	if upstreamLatencies.len() > 0 {
+		metrics.UpstreamRequests = upstreamLatencies.count
+		metrics.UpstreamP50Latency, metrics.UpstreamP95Latency, metrics.UpstreamP99Latency = upstreamLatencies.latencyPercentiles(method)
+
+		for addr, latencies := range upstreamByAddr {
+			metrics.UpstreamBreakdown[addr.String()] = newUpstreamMetrics(latencies, method)
+		}
 	}
 
 	return metrics
@@ -122,19 +477,37 @@ func (wa *WindowAggregator) calculateMetrics() *WindowMetrics {
 
 // GetCurrentWindowStart returns the start time of the current window
 func (wa *WindowAggregator) GetCurrentWindowStart() int64 {
-	wa.mutex.RLock()
-	defer wa.mutex.RUnlock()
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
 	return wa.windowStart
 }
 
 // GetSampleCount returns the number of samples in the current window
 func (wa *WindowAggregator) GetSampleCount() int {
-	wa.mutex.RLock()
-	defer wa.mutex.RUnlock()
+	return wa.active.Load().count()
+}
+
+// newUpstreamMetrics summarizes the upstream latencies of a single upstream address
+func newUpstreamMetrics(latencies *weightedValues, method PercentileMethod) *UpstreamMetrics {
+	metrics := &UpstreamMetrics{
+		Requests:   latencies.count,
+		AvgLatency: latencies.avgLatency(),
+	}
+	metrics.P50Latency, metrics.P95Latency, metrics.P99Latency = latencies.latencyPercentiles(method)
+	return metrics
+}
 
-	count := 0
-	for _, latencies := range wa.currentWindow {
-		count += len(latencies)
+// newSizeBucketMetrics summarizes the latencies of one response size bucket
+func newSizeBucketMetrics(bucket int, latencies *weightedValues, method PercentileMethod) *SizeBucketMetrics {
+	metrics := &SizeBucketMetrics{
+		Bucket:     responseSizeBuckets[bucket].label,
+		MaxBytes:   responseSizeBuckets[bucket].maxBytes,
+		Requests:   latencies.count,
+		AvgLatency: latencies.avgLatency(),
 	}
-	return count
+	metrics.P50Latency, metrics.P95Latency, metrics.P99Latency = latencies.latencyPercentiles(method)
+	return metrics
 }
+
+// standardPercentiles are the percentiles reported for every distribution
+var standardPercentiles = []float64{50, 95, 99}